@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// schedulerClient sends the requests to schedulers: the transport, rate
+// limited if configureRateLimit says so, and the headers newRequest sets.
+// It isn't changed once in use, reload builds a new one instead, see
+// setClient.
+type schedulerClient struct {
+	// transport asks for gzip and decompresses such responses
+	// transparently, which keeps large /vars.json payloads small on the
+	// wire. Setting Accept-Encoding on a request would turn that off.
+	transport *http.Transport
+	// http talks to the schedulers through transport, observed by
+	// schedulerRequests.
+	http *http.Client
+
+	userAgent string
+
+	// Credentials sent with every request, see configureBasicAuth and
+	// configureBearerToken.
+	basicAuthUser, basicAuthPassword string
+	bearerTokenFile                  string
+}
+
+// newSchedulerClient returns a client with the default settings, for the
+// configure methods to change before it's used.
+func newSchedulerClient() *schedulerClient {
+	transport := &http.Transport{
+		MaxIdleConnsPerHost:   2,
+		ResponseHeaderTimeout: 10 * time.Second,
+		Dial: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 10 * time.Second,
+		}).Dial,
+	}
+
+	return &schedulerClient{
+		transport: transport,
+		http:      &http.Client{Transport: instrumentedTransport{next: transport}},
+		userAgent: "aurora_exporter/" + version,
+	}
+}
+
+var (
+	clientMu      sync.Mutex
+	clientCurrent atomic.Value // *schedulerClient
+	defaultClient = newSchedulerClient()
+)
+
+// currentClient returns the client scheduler requests are sent with.
+func currentClient() *schedulerClient {
+	if c, ok := clientCurrent.Load().(*schedulerClient); ok {
+		return c
+	}
+
+	return defaultClient
+}
+
+// setClient makes subsequent requests use c. Requests in flight finish with
+// the client they started with, the idle connections of which are closed.
+func setClient(c *schedulerClient) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	old := currentClient()
+	clientCurrent.Store(c)
+	if old != c {
+		old.transport.CloseIdleConnections()
+	}
+}
+
+var schedulerRequests = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scheduler_request_duration_seconds",
+		Help:      "Duration of requests to schedulers, by type and status code",
+	},
+	[]string{"type", "code"},
+)
+
+// requestTypeKey is the context key of the type a scheduler request is
+// observed as, "scrape" unless set by withRequestType.
+type requestTypeKey struct{}
+
+func withRequestType(ctx context.Context, typ string) context.Context {
+	return context.WithValue(ctx, requestTypeKey{}, typ)
+}
+
+// instrumentedTransport observes the requests sent through next in
+// schedulerRequests, the status code of failed ones as "error".
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	typ, ok := req.Context().Value(requestTypeKey{}).(string)
+	if !ok {
+		typ = "scrape"
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	schedulerRequests.WithLabelValues(typ, code).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// configureTransport bounds the idle connections c keeps to the schedulers.
+func (c *schedulerClient) configureTransport(maxIdleConns int, idleConnTimeout time.Duration) error {
+	if maxIdleConns < 0 || idleConnTimeout < 0 {
+		return errors.New("http: idle connection limits must not be negative")
+	}
+
+	c.transport.MaxIdleConns = maxIdleConns
+	c.transport.IdleConnTimeout = idleConnTimeout
+	if maxIdleConns > 0 && maxIdleConns < c.transport.MaxIdleConnsPerHost {
+		c.transport.MaxIdleConnsPerHost = maxIdleConns
+	}
+
+	return nil
+}
+
+// configureTLS sets up the TLS configuration c uses to talk to schedulers
+// served over https.
+func (c *schedulerClient) configureTLS(caFile, certFile, keyFile string, insecure bool) error {
+	cfg, err := newTLSConfig(caFile, certFile, keyFile, insecure)
+	if err != nil {
+		return err
+	}
+
+	c.transport.TLSClientConfig = cfg
+
+	return nil
+}
+
+// errRateLimited is returned for requests over the rate limit when they
+// fail fast instead of waiting.
+var errRateLimited = errors.New("http: rate limit exceeded")
+
+// configureRateLimit limits the requests of c, including those following
+// redirects, to rate per second with bursts of up to burst. Over the limit,
+// requests wait for their turn or, with failFast, fail right away. A rate of
+// 0 disables the limit.
+func (c *schedulerClient) configureRateLimit(rate float64, burst int, failFast bool) error {
+	if rate < 0 || burst < 1 {
+		return errors.New("http: rate limit must not be negative and burst must be positive")
+	}
+
+	instrumented := instrumentedTransport{next: c.transport}
+	if rate == 0 {
+		c.http.Transport = instrumented
+		return nil
+	}
+
+	c.http.Transport = &rateLimiter{
+		next:     instrumented,
+		rate:     rate,
+		burst:    float64(burst),
+		failFast: failFast,
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+
+	return nil
+}
+
+// rateLimiter is a token bucket in front of next, holding up to burst
+// tokens and refilled at rate per second. Each request takes a token.
+type rateLimiter struct {
+	next     http.RoundTripper
+	rate     float64
+	burst    float64
+	failFast bool
+
+	sync.Mutex
+	tokens float64 // negative while requests wait for theirs
+	last   time.Time
+}
+
+func (l *rateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	wait, ok := l.reserve()
+	if !ok {
+		return nil, errRateLimited
+	}
+
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	return l.next.RoundTrip(req)
+}
+
+// reserve takes a token and returns how long to wait until it is due. It
+// reports false if the request should fail fast instead.
+func (l *rateLimiter) reserve() (time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if l.failFast {
+		return 0, false
+	}
+
+	// Requests queue up behind those already waiting.
+	l.tokens--
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), true
+}
+
+// newZkTLSConfig returns the TLS configuration of ZooKeeper connections if
+// any of the files is given, and nil for plain TCP otherwise.
+func newZkTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	return newTLSConfig(caFile, certFile, keyFile, false)
+}
+
+func newTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("tls: cert and key file must be provided together")
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("tls: no certificates found in CA file")
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// configureBasicAuth sets the credentials newRequest attaches. The password
+// is read from passwordFile when one is given.
+func (c *schedulerClient) configureBasicAuth(username, password, passwordFile string) error {
+	if password != "" && passwordFile != "" {
+		return errors.New("basic auth: password and password file are mutually exclusive")
+	}
+
+	if passwordFile != "" {
+		b, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return err
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+
+	if username == "" && password != "" {
+		return errors.New("basic auth: password given without a username")
+	}
+
+	c.basicAuthUser, c.basicAuthPassword = username, password
+
+	return nil
+}
+
+// configureBearerToken makes newRequest send the token in file as bearer
+// token. The file is read for every request, so rotated tokens are picked
+// up right away.
+func (c *schedulerClient) configureBearerToken(file string) error {
+	if file != "" && c.basicAuthUser != "" {
+		return errors.New("bearer token: basic auth and bearer token are mutually exclusive")
+	}
+	c.bearerTokenFile = file
+
+	return nil
+}
+
+// bearerToken reads the token from the bearer token file. A missing or
+// empty file fails the request rather than sending it unauthenticated.
+func (c *schedulerClient) bearerToken() (string, error) {
+	b, err := ioutil.ReadFile(c.bearerTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("bearer token: %s", err)
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("bearer token: %s is empty", c.bearerTokenFile)
+	}
+
+	return token, nil
+}
+
+func (c *schedulerClient) newRequest(method, urlStr string, body io.Reader, bypass bool) (*http.Request, error) {
+	req, err := http.NewRequest(method, urlStr, body)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.basicAuthUser != "" {
+		req.SetBasicAuth(c.basicAuthUser, c.basicAuthPassword)
+	}
+	if c.bearerTokenFile != "" {
+		token, err := c.bearerToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if bypass {
+		req.Header.Add("Bypass-Leader-Redirect", "true")
+	}
+
+	return req, nil
+}
+
+// retryDelay is the wait before the first retry of a scheduler request
+// answered with a gateway or availability error, it doubles per retry.
+const retryDelay = 250 * time.Millisecond
+
+// get fetches urlStr, retrying up to retries times on 502, 503 and 504, which
+// a scheduler answers with briefly during leader re-election. Retries stop
+// when ctx is done. Responses other than 200 are returned as errors.
+func (c *schedulerClient) get(ctx context.Context, urlStr string, bypass bool, retries int) (*http.Response, error) {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest("GET", urlStr, nil, bypass)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.http.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, redactError(err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		err = fmt.Errorf("%s: unexpected status %s", redactURL(urlStr), resp.Status)
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return nil, err
+		}
+		if attempt >= retries {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
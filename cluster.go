@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clusterLabel tells apart the metrics of the -exporter.cluster targets.
+const clusterLabel = "cluster"
+
+// clusterFlag collects the repeatable -exporter.cluster name=url flag, in
+// the order given.
+type clusterFlag struct {
+	names []string
+	urls  map[string]string
+}
+
+func (c *clusterFlag) String() string {
+	var pairs []string
+	for _, name := range c.names {
+		pairs = append(pairs, name+"="+c.urls[name])
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (c *clusterFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("cluster %q must be name=url", s)
+	}
+
+	name, url := parts[0], parts[1]
+	if _, dup := c.urls[name]; dup {
+		return fmt.Errorf("cluster %q given twice", name)
+	}
+	c.names = append(c.names, name)
+	c.urls[name] = url
+
+	return nil
+}
+
+// targets returns the names and URLs of the clusters to scrape. Without any
+// cluster, that is the scheduler at url under the empty name.
+func (c *clusterFlag) targets(url string) (names, urls []string) {
+	if len(c.names) == 0 {
+		return []string{""}, []string{url}
+	}
+
+	for _, name := range c.names {
+		urls = append(urls, c.urls[name])
+	}
+
+	return c.names, urls
+}
+
+// clusterCollector collects several exporters, up to concurrency at once or
+// all of them if it's 0. They describe the same metrics, so only the first
+// is described, and their metrics must be told apart by a cluster label.
+type clusterCollector struct {
+	collectors  []prometheus.Collector
+	concurrency int32 // accessed atomically, see setConcurrency
+}
+
+// setConcurrency makes the collections after those in progress collect up
+// to n clusters at once.
+func (c *clusterCollector) setConcurrency(n int) {
+	atomic.StoreInt32(&c.concurrency, int32(n))
+}
+
+func (c *clusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	if len(c.collectors) > 0 {
+		c.collectors[0].Describe(ch)
+	}
+}
+
+func (c *clusterCollector) Collect(ch chan<- prometheus.Metric) {
+	n := int(atomic.LoadInt32(&c.concurrency))
+	if n <= 0 || n > len(c.collectors) {
+		n = len(c.collectors)
+	}
+
+	// Each exporter records its own errors, a failing cluster doesn't keep
+	// the others from being collected.
+	slots := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for _, col := range c.collectors {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(col prometheus.Collector) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			col.Collect(ch)
+		}(col)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// slowCollector takes a while to collect, recording how many collect at
+// once.
+type slowCollector struct {
+	active, max *int32
+}
+
+func (c slowCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c slowCollector) Collect(ch chan<- prometheus.Metric) {
+	n := atomic.AddInt32(c.active, 1)
+	defer atomic.AddInt32(c.active, -1)
+	for {
+		max := atomic.LoadInt32(c.max)
+		if n <= max || atomic.CompareAndSwapInt32(c.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestClusterCollectorConcurrency(t *testing.T) {
+	for _, test := range []struct{ concurrency, want int32 }{{0, 4}, {2, 2}, {10, 4}} {
+		var active, max int32
+		c := &clusterCollector{}
+		for i := 0; i < 4; i++ {
+			c.collectors = append(c.collectors, slowCollector{&active, &max})
+		}
+		c.setConcurrency(int(test.concurrency))
+
+		c.Collect(make(chan prometheus.Metric))
+
+		if max != test.want {
+			t.Errorf("with concurrency %d, %d clusters were collected at once, want %d", test.concurrency, max, test.want)
+		}
+	}
+}
+
+func TestClusterFlag(t *testing.T) {
+	c := &clusterFlag{urls: make(map[string]string)}
+	if names, urls := c.targets("http://aurora:8081"); !reflect.DeepEqual(names, []string{""}) || !reflect.DeepEqual(urls, []string{"http://aurora:8081"}) {
+		t.Errorf("without clusters got targets %v %v", names, urls)
+	}
+
+	for _, s := range []string{"west=zk://zk-west:2181", "east=http://east:8081=x"} {
+		if err := c.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, urls := c.targets("http://aurora:8081")
+	if !reflect.DeepEqual(names, []string{"west", "east"}) || !reflect.DeepEqual(urls, []string{"zk://zk-west:2181", "http://east:8081=x"}) {
+		t.Errorf("got targets %v %v, want them in the order given", names, urls)
+	}
+	if got := c.String(); got != "west=zk://zk-west:2181,east=http://east:8081=x" {
+		t.Errorf("String() = %q", got)
+	}
+
+	for _, s := range []string{"west=http://other", "west", "=http://x", "east="} {
+		if err := c.Set(s); err == nil {
+			t.Errorf("cluster %q was accepted", s)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config is the layout of the -config.file YAML document. Every setting
+// corresponds to a command-line flag, which takes precedence when given.
+type config struct {
+	AuroraURL            *string `yaml:"aurora_url"`
+	BypassLeaderRedirect *string `yaml:"bypass_leader_redirect"`
+	UnknownVars          *string `yaml:"unknown_vars"`
+	NoLeaderOK           *string `yaml:"no_leader_ok"`
+	FinderType           *string `yaml:"finder_type"`
+	FallbackURL          *string `yaml:"fallback_url"`
+	FallbackAfter        *string `yaml:"fallback_after"`
+
+	Scrape struct {
+		Timeout         *string `yaml:"timeout"`
+		TimeoutOffset   *string `yaml:"timeout_offset"`
+		Path            *string `yaml:"path"`
+		Retries         *string `yaml:"retries"`
+		BreakerFailures *string `yaml:"breaker_failures"`
+		BreakerCooldown *string `yaml:"breaker_cooldown"`
+		ServeStale      *string `yaml:"serve_stale"`
+		Concurrency     *string `yaml:"concurrency"`
+	} `yaml:"scrape"`
+
+	Probe struct {
+		MaxTargets *string `yaml:"max_targets"`
+	} `yaml:"probe"`
+
+	Metric struct {
+		Include *string `yaml:"include"`
+		Exclude *string `yaml:"exclude"`
+	} `yaml:"metric"`
+
+	Compat struct {
+		Untyped *string `yaml:"untyped"`
+	} `yaml:"compat"`
+
+	ZK struct {
+		Znode            *string `yaml:"znode"`
+		LeaderPrefix     *string `yaml:"leader_prefix"`
+		Auth             *string `yaml:"auth"`
+		ReadHosts        *string `yaml:"read_hosts"`
+		AcceptedStatuses *string `yaml:"accepted_statuses"`
+		EntityFormat     *string `yaml:"entity_format"`
+		SessionTimeout   *string `yaml:"session_timeout"`
+		ResolveInterval  *string `yaml:"resolve_interval"`
+		WatchInterval    *string `yaml:"watch_interval"`
+		WatchMaxInterval *string `yaml:"watch_max_interval"`
+		WatchJitter      *string `yaml:"watch_jitter"`
+		LogEvents        *string `yaml:"log_events"`
+
+		TLS struct {
+			CAFile   *string `yaml:"ca_file"`
+			CertFile *string `yaml:"cert_file"`
+			KeyFile  *string `yaml:"key_file"`
+		} `yaml:"tls"`
+	} `yaml:"zk"`
+
+	Leader struct {
+		CacheTTL       *string `yaml:"cache_ttl"`
+		PreferEndpoint *string `yaml:"prefer_endpoint"`
+	} `yaml:"leader"`
+
+	HTTP struct {
+		Retries         *string `yaml:"retries"`
+		Timeout         *string `yaml:"timeout"`
+		MaxIdleConns    *string `yaml:"max_idle_conns"`
+		IdleConnTimeout *string `yaml:"idle_conn_timeout"`
+		RateLimit       *string `yaml:"rate_limit"`
+		RateBurst       *string `yaml:"rate_burst"`
+		RateFailFast    *string `yaml:"rate_fail_fast"`
+		UserAgent       *string `yaml:"user_agent"`
+		Username        *string `yaml:"username"`
+		Password        *string `yaml:"password"`
+		PasswordFile    *string `yaml:"password_file"`
+		BearerTokenFile *string `yaml:"bearer_token_file"`
+	} `yaml:"http"`
+
+	TLS struct {
+		CAFile             *string `yaml:"ca_file"`
+		CertFile           *string `yaml:"cert_file"`
+		KeyFile            *string `yaml:"key_file"`
+		InsecureSkipVerify *string `yaml:"insecure_skip_verify"`
+	} `yaml:"tls"`
+}
+
+// flags maps the settings of c to the flags they stand for.
+func (c *config) flags() map[string]*string {
+	return map[string]*string{
+		"exporter.aurora-url":             c.AuroraURL,
+		"exporter.bypass-leader-redirect": c.BypassLeaderRedirect,
+		"exporter.unknown-vars":           c.UnknownVars,
+		"exporter.no-leader-ok":           c.NoLeaderOK,
+		"finder.type":                     c.FinderType,
+		"finder.fallback-url":             c.FallbackURL,
+		"finder.fallback-after":           c.FallbackAfter,
+		"scrape.timeout":                  c.Scrape.Timeout,
+		"scrape.timeout-offset":           c.Scrape.TimeoutOffset,
+		"scrape.path":                     c.Scrape.Path,
+		"scrape.retries":                  c.Scrape.Retries,
+		"scrape.breaker-failures":         c.Scrape.BreakerFailures,
+		"scrape.breaker-cooldown":         c.Scrape.BreakerCooldown,
+		"scrape.serve-stale":              c.Scrape.ServeStale,
+		"scrape.concurrency":              c.Scrape.Concurrency,
+		"probe.max-targets":               c.Probe.MaxTargets,
+		"metric.include":                  c.Metric.Include,
+		"metric.exclude":                  c.Metric.Exclude,
+		"compat.untyped":                  c.Compat.Untyped,
+		"zk.znode":                        c.ZK.Znode,
+		"zk.leader-prefix":                c.ZK.LeaderPrefix,
+		"zk.auth":                         c.ZK.Auth,
+		"zk.read-hosts":                   c.ZK.ReadHosts,
+		"zk.accepted-statuses":            c.ZK.AcceptedStatuses,
+		"zk.entity-format":                c.ZK.EntityFormat,
+		"zk.session-timeout":              c.ZK.SessionTimeout,
+		"zk.resolve-interval":             c.ZK.ResolveInterval,
+		"zk.watch-interval":               c.ZK.WatchInterval,
+		"zk.watch-max-interval":           c.ZK.WatchMaxInterval,
+		"zk.watch-jitter":                 c.ZK.WatchJitter,
+		"zk.log-events":                   c.ZK.LogEvents,
+		"zk.tls.ca-file":                  c.ZK.TLS.CAFile,
+		"zk.tls.cert-file":                c.ZK.TLS.CertFile,
+		"zk.tls.key-file":                 c.ZK.TLS.KeyFile,
+		"leader.cache-ttl":                c.Leader.CacheTTL,
+		"leader.prefer-endpoint":          c.Leader.PreferEndpoint,
+		"http.retries":                    c.HTTP.Retries,
+		"http.timeout":                    c.HTTP.Timeout,
+		"http.max-idle-conns":             c.HTTP.MaxIdleConns,
+		"http.idle-conn-timeout":          c.HTTP.IdleConnTimeout,
+		"http.rate-limit":                 c.HTTP.RateLimit,
+		"http.rate-burst":                 c.HTTP.RateBurst,
+		"http.rate-fail-fast":             c.HTTP.RateFailFast,
+		"http.user-agent":                 c.HTTP.UserAgent,
+		"http.username":                   c.HTTP.Username,
+		"http.password":                   c.HTTP.Password,
+		"http.password-file":              c.HTTP.PasswordFile,
+		"http.bearer-token-file":          c.HTTP.BearerTokenFile,
+		"tls.ca-file":                     c.TLS.CAFile,
+		"tls.cert-file":                   c.TLS.CertFile,
+		"tls.key-file":                    c.TLS.KeyFile,
+		"tls.insecure-skip-verify":        c.TLS.InsecureSkipVerify,
+	}
+}
+
+var envRE = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} in s with the value of the environment variable.
+// Only the braced form is expanded, so a $ in a password stays as it is.
+// Unset variables expand to nothing, or with -env.strict are an error.
+func expandEnv(s string) (string, error) {
+	var unset []string
+	s = envRE.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRE.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return v
+	})
+
+	if *envStrict && len(unset) > 0 {
+		return "", fmt.Errorf("env: %s not set", strings.Join(unset, ", "))
+	}
+
+	return s, nil
+}
+
+// loadConfig reads the YAML config at path, rejecting unknown keys.
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("config: %s: %s", path, err)
+	}
+
+	return c, nil
+}
+
+// applyConfig sets the flags from c, except those in explicit, which were
+// given on the command line. Flags c doesn't mention are reset to their
+// default, so settings removed from the file on reload don't linger.
+func applyConfig(c *config, explicit map[string]bool) error {
+	for name, v := range c.flags() {
+		if explicit[name] {
+			continue
+		}
+
+		value := flag.Lookup(name).DefValue
+		if v != nil {
+			value = *v
+		}
+
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("config: %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// explicitFlags returns the names of the flags given on the command line.
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	return explicit
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// entityDecoder turns the payload of a leader zNode into the scheduler
+// endpoint to scrape. endpoint names the additional endpoint to prefer, for
+// formats that have several.
+type entityDecoder interface {
+	decode(payload, endpoint string) (zkLeader, error)
+}
+
+// entityDecoders are the zNode formats selectable by -zk.entity-format.
+var entityDecoders = map[string]entityDecoder{
+	"serverset": serverSetDecoder{},
+	"hostport":  hostPortDecoder{},
+}
+
+func newEntityDecoder(format string) (entityDecoder, error) {
+	if d, ok := entityDecoders[format]; ok {
+		return d, nil
+	}
+
+	var formats []string
+	for f := range entityDecoders {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+
+	return nil, fmt.Errorf("zkFinder: unknown entity format %q, must be one of %s", format, strings.Join(formats, ", "))
+}
+
+type endpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// entity is the ServerSet member Aurora publishes in a leader zNode.
+type entity struct {
+	ServiceEndpoint     endpoint            `json:"serviceEndpoint"`
+	AdditionalEndpoints map[string]endpoint `json:"additionalEndpoints"`
+	Status              string              `json:"status"`
+}
+
+// serverSetDecoder decodes JSON ServerSet entities and, for older
+// schedulers, falls back to bare host:port payloads.
+type serverSetDecoder struct{}
+
+func (serverSetDecoder) decode(payload, endpoint string) (zkLeader, error) {
+	if !strings.HasPrefix(payload, "{") {
+		return hostPortDecoder{}.decode(payload, endpoint)
+	}
+
+	var e entity
+	if err := json.Unmarshal([]byte(payload), &e); err != nil {
+		return zkLeader{}, err
+	}
+
+	// Aurora names its additional endpoints after their scheme.
+	leader := zkLeader{scheme: "http", ip: e.ServiceEndpoint.Host, port: e.ServiceEndpoint.Port, status: e.Status}
+	if ep, ok := e.AdditionalEndpoints[endpoint]; ok {
+		if endpoint == "https" {
+			leader.scheme = "https"
+		}
+		leader.ip, leader.port = ep.Host, ep.Port
+	}
+
+	// An entity without an endpoint, like {}, must not replace the leader.
+	if leader.ip == "" || leader.port <= 0 || leader.port > 65535 {
+		return zkLeader{}, fmt.Errorf("zkFinder: leader entity %q has no host and port", payload)
+	}
+	if !validHost(leader.ip) {
+		return zkLeader{}, fmt.Errorf("zkFinder: bad host in leader entity %q", payload)
+	}
+
+	return leader, nil
+}
+
+// hostPortDecoder decodes a plain host:port, or just the host of a scheduler
+// on the default port.
+type hostPortDecoder struct{}
+
+func (hostPortDecoder) decode(payload, endpoint string) (zkLeader, error) {
+	payload = strings.TrimSpace(payload)
+
+	host, port, err := net.SplitHostPort(payload)
+	p := schedulerPort
+	if err != nil {
+		// No port, or an IPv6 address without one.
+		host = payload
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	} else if p, err = strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return zkLeader{}, fmt.Errorf("zkFinder: bad port in leader %q", payload)
+	}
+
+	if !validHost(host) {
+		return zkLeader{}, fmt.Errorf("zkFinder: bad host in leader %q", payload)
+	}
+
+	return zkLeader{scheme: "http", ip: host, port: p, noStatus: true}, nil
+}
+
+var hostNameRE = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.?$`)
+
+// validHost reports whether host is an IP address or a host name.
+func validHost(host string) bool {
+	return net.ParseIP(host) != nil || len(host) <= 253 && hostNameRE.MatchString(host)
+}
@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestServerSetDecoder(t *testing.T) {
+	tests := []struct {
+		payload, endpoint string
+		want              zkLeader
+	}{
+		{
+			payload: `{"serviceEndpoint":{"host":"10.0.0.1","port":31337},"status":"ALIVE"}`,
+			want:    zkLeader{scheme: "http", ip: "10.0.0.1", port: 31337, status: "ALIVE"},
+		},
+		{
+			payload:  `{"serviceEndpoint":{"host":"10.0.0.1","port":31337},"additionalEndpoints":{"http":{"host":"10.0.0.1","port":8081}},"status":"ALIVE"}`,
+			endpoint: "http",
+			want:     zkLeader{scheme: "http", ip: "10.0.0.1", port: 8081, status: "ALIVE"},
+		},
+		{
+			payload:  `{"serviceEndpoint":{"host":"10.0.0.1","port":31337},"additionalEndpoints":{"https":{"host":"scheduler","port":8443}},"status":"ALIVE"}`,
+			endpoint: "https",
+			want:     zkLeader{scheme: "https", ip: "scheduler", port: 8443, status: "ALIVE"},
+		},
+		{
+			// A missing additional endpoint falls back to the service one.
+			payload:  `{"serviceEndpoint":{"host":"10.0.0.1","port":31337},"status":"DEAD"}`,
+			endpoint: "https",
+			want:     zkLeader{scheme: "http", ip: "10.0.0.1", port: 31337, status: "DEAD"},
+		},
+		{
+			payload: "10.0.0.2:8081",
+			want:    zkLeader{scheme: "http", ip: "10.0.0.2", port: 8081, noStatus: true},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := serverSetDecoder{}.decode(test.payload, test.endpoint)
+		if err != nil {
+			t.Errorf("decode(%s): %s", test.payload, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("decode(%s) = %+v, want %+v", test.payload, got, test.want)
+		}
+	}
+}
+
+func TestServerSetDecoderRejectsEntitiesWithoutHost(t *testing.T) {
+	for _, payload := range []string{
+		`{}`,
+		`{"status":"ALIVE"}`,
+		`{"serviceEndpoint":{"port":8081},"status":"ALIVE"}`,
+		`{"serviceEndpoint":{"host":"10.0.0.1"},"status":"ALIVE"}`,
+		`{"serviceEndpoint":{"host":"10.0.0.1","port":8081},"additionalEndpoints":{"http":{}},"status":"ALIVE"}`,
+		`{"serviceEndpoint":{"host":"not a host","port":8081},"status":"ALIVE"}`,
+		`{"serviceEndpoint":`,
+	} {
+		if leader, err := (serverSetDecoder{}).decode(payload, "http"); err == nil {
+			t.Errorf("decode(%s) = %+v, want an error", payload, leader)
+		}
+	}
+}
+
+func TestHostPortDecoder(t *testing.T) {
+	tests := map[string]zkLeader{
+		"10.0.0.1:8081":                {scheme: "http", ip: "10.0.0.1", port: 8081, noStatus: true},
+		"scheduler:31337":              {scheme: "http", ip: "scheduler", port: 31337, noStatus: true},
+		"10.0.0.1":                     {scheme: "http", ip: "10.0.0.1", port: schedulerPort, noStatus: true},
+		"[2001:db8::1]:8081":           {scheme: "http", ip: "2001:db8::1", port: 8081, noStatus: true},
+		"2001:db8::1":                  {scheme: "http", ip: "2001:db8::1", port: schedulerPort, noStatus: true},
+		"scheduler.example.com:8081\n": {scheme: "http", ip: "scheduler.example.com", port: 8081, noStatus: true},
+	}
+
+	for payload, want := range tests {
+		got, err := hostPortDecoder{}.decode(payload, "")
+		if err != nil {
+			t.Errorf("decode(%s): %s", payload, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("decode(%s) = %+v, want %+v", payload, got, want)
+		}
+	}
+
+	for _, payload := range []string{"10.0.0.1:0", "10.0.0.1:65536", "10.0.0.1:http", "garbage payload", "",
+		"host:8081:extra", "-scheduler:8081", "sched_uler", "[10.0.0.1", "http://10.0.0.1:8081"} {
+		if leader, err := (hostPortDecoder{}).decode(payload, ""); err == nil {
+			t.Errorf("decode(%s) = %+v, want an error", payload, leader)
+		}
+	}
+}
+
+func TestNewEntityDecoder(t *testing.T) {
+	for _, format := range []string{"serverset", "hostport"} {
+		if _, err := newEntityDecoder(format); err != nil {
+			t.Errorf("format %s: %s", format, err)
+		}
+	}
+
+	if _, err := newEntityDecoder("json"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -1,197 +1,1484 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"net/http"
+	"math/rand"
+	"net"
 	"net/url"
+	"path"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/samuel/go-zookeeper/zk"
 )
 
 const (
-	zkPath         = "/aurora/scheduler"
+	zkPath         = "/aurora/scheduler" // default leader zNode path
 	zkLeaderPrefix = "singleton_candidate_"
+
+	// schedulerPort is the port assumed for leaders published as a bare IP.
+	schedulerPort = 8081
+
+	// SOH is the control byte ZooKeeper may leave in a zNode payload while
+	// it is being rewritten.
+	SOH = "\x01"
+)
+
+// Errors finders return, possibly with context added by wrapError. Compare
+// them against errorCause of the returned error.
+var (
+	ErrNoLeader      = errors.New("no leader found")
+	ErrZNodeNotFound = errors.New("zNode not found")
+	ErrBadAddress    = errors.New("bad address")
 )
 
+// wrappedError adds context to one of the errors above.
+type wrappedError struct {
+	msg   string
+	cause error
+}
+
+func (e *wrappedError) Error() string {
+	return e.msg + ": " + e.cause.Error()
+}
+
+func wrapError(cause error, format string, args ...interface{}) error {
+	return &wrappedError{msg: fmt.Sprintf(format, args...), cause: cause}
+}
+
+// errorCause returns the error err was wrapped around, or err itself.
+func errorCause(err error) error {
+	for {
+		w, ok := err.(*wrappedError)
+		if !ok {
+			return err
+		}
+		err = w.cause
+	}
+}
+
+// finderMetrics are the metrics about finding the leader. Every finder has
+// its own, shared with the finders it falls back to, so the metrics of one
+// cluster or probe don't mix with those of another and a closed finder can't
+// reset the series of the one replacing it. See metricsOf.
+type finderMetrics struct {
+	lastUpdate         prometheus.Gauge
+	transitions        prometheus.Counter
+	watchErrors        *prometheus.CounterVec
+	leaderRejected     *prometheus.CounterVec
+	connected          prometheus.Gauge
+	leaderMtime        prometheus.Gauge
+	leaderVersion      prometheus.Gauge
+	servers            prometheus.Gauge
+	currentServer      *prometheus.GaugeVec
+	sessionExpirations prometheus.Counter
+	watchRestarts      prometheus.Counter
+	memberSequence     *prometheus.GaugeVec
+	memberElected      *prometheus.GaugeVec
+}
+
+func newFinderMetrics() *finderMetrics {
+	return &finderMetrics{
+		lastUpdate: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "leader_last_update_timestamp_seconds",
+				Help:      "Unix time the scheduler leader was last resolved",
+			}),
+		transitions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "leader_transitions_total",
+				Help:      "Number of times the leader found in ZooKeeper changed to another host and port",
+			}),
+		watchErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "zk_watch_errors_total",
+				Help:      "ZooKeeper leader watch errors, by reason",
+			},
+			[]string{"reason"},
+		),
+		leaderRejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "zk_leader_rejected_total",
+				Help:      "Leader zNode entities ignored because of their status, by status",
+			},
+			[]string{"status"},
+		),
+		connected: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "zk_connected",
+				Help:      "Whether the ZooKeeper session is established",
+			}),
+		leaderMtime: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "leader_znode_mtime_seconds",
+				Help:      "Unix time the leader zNode was last modified",
+			}),
+		leaderVersion: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "leader_znode_version",
+				Help:      "Data version of the leader zNode",
+			}),
+		servers: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "zk_servers",
+				Help:      "Number of ZooKeeper servers the exporter connects to",
+			}),
+		currentServer: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "zk_current_server",
+				Help:      "ZooKeeper server the session is attached to, always 1",
+			},
+			[]string{"host"},
+		),
+		sessionExpirations: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "zk_session_expirations_total",
+				Help:      "Number of expired ZooKeeper sessions",
+			}),
+		watchRestarts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "zk_watch_restarts_total",
+				Help:      "Number of times the ZooKeeper watch loop was restarted after a panic",
+			}),
+		memberSequence: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "zk_member_sequence",
+				Help:      "Sequence number of a leader candidate zNode",
+			},
+			[]string{"member"},
+		),
+		memberElected: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "zk_member_elected",
+				Help:      "Whether a leader candidate zNode holds the leadership",
+			},
+			[]string{"member"},
+		),
+	}
+}
+
+func (m *finderMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.lastUpdate, m.transitions, m.watchErrors, m.leaderRejected, m.connected, m.leaderMtime,
+		m.leaderVersion, m.servers, m.currentServer, m.sessionExpirations, m.watchRestarts,
+		m.memberSequence, m.memberElected,
+	}
+}
+
+func (m *finderMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+func (m *finderMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *finderMetrics) setLastUpdate(t time.Time) {
+	m.lastUpdate.Set(float64(t.UnixNano()) / 1e9)
+}
+
+// metricsOf returns the metrics of f, nil if it has none.
+func metricsOf(f finder) *finderMetrics {
+	switch f := f.(type) {
+	case *cachingFinder:
+		return metricsOf(f.finder)
+	case *compositeFinder:
+		return metricsOf(f.finders[0])
+	case *httpFinder:
+		return f.metrics
+	case *listFinder:
+		return f.metrics
+	case *zkFinder:
+		return f.metrics
+	}
+
+	return nil
+}
+
 type finder interface {
-	leaderURL() (string, error)
+	// leaderURL returns the URL of the leader, giving up on lookups when
+	// ctx is done.
+	leaderURL(ctx context.Context) (string, error)
+	Close() error
+}
+
+// FinderConfig are the settings of a finder. Zero values stand for the
+// defaults noted, which match those of the corresponding flags.
+type FinderConfig struct {
+	// Type the Address must be for, one of auto, http, list or zk.
+	// Defaults to auto, which takes the type from the scheme.
+	Type string
+	// Address is an http(s)://, list:// or zk:// URL, see the README.
+	Address string
+
+	// ZNode are the comma-separated zNode paths to look for the leader
+	// under, in order of priority. Defaults to /aurora/scheduler.
+	ZNode string
+	// ZKLeaderPrefix is the name prefix of the leader candidate zNodes.
+	// Defaults to singleton_candidate_.
+	ZKLeaderPrefix string
+	// ZKAuth is the authentication as scheme:credential, if any.
+	ZKAuth string
+	// ZKReadHosts are comma-separated servers to connect to instead of
+	// those in the Address, if any.
+	ZKReadHosts string
+	// ZKStatuses are the comma-separated accepted leader entity statuses,
+	// an empty one accepts entities without a status. Defaults to ALIVE.
+	ZKStatuses string
+	// ZKEntityFormat is the format of the leader zNode payload, serverset
+	// or hostport. Defaults to serverset.
+	ZKEntityFormat string
+	// ZKSessionTimeout defaults to 20s.
+	ZKSessionTimeout time.Duration
+	// ZKResolveInterval is the minimum interval between resolving the
+	// server names again after failing to connect to all their addresses.
+	// They are resolved only once by default.
+	ZKResolveInterval time.Duration
+	// ZKWatchInterval is the interval between leader lookups, backing off
+	// up to ZKWatchMaxInterval after errors. They default to 1s and 30s.
+	ZKWatchInterval    time.Duration
+	ZKWatchMaxInterval time.Duration
+	// ZKWatchJitter is the fraction by which lookup intervals are randomly
+	// spread, none by default.
+	ZKWatchJitter float64
+	// ZKLogEvents logs the connection events at debug level.
+	ZKLogEvents bool
+	// ZKTLS, if set, is the TLS configuration of ZooKeeper connections,
+	// see newZkTLSConfig.
+	ZKTLS *tls.Config
+	// LeaderEndpoint is the additional leader endpoint to scrape, the
+	// service endpoint is scraped if it's empty or missing.
+	LeaderEndpoint string
+
+	// HTTPRetries is the number of times a failed HTTP lookup is retried,
+	// none by default.
+	HTTPRetries int
+	// HTTPTimeout is the timeout of a single HTTP lookup attempt. Defaults
+	// to 10s.
+	HTTPTimeout time.Duration
+
+	// Metrics record the lookups of the finder. Defaults to a new set.
+	Metrics *finderMetrics
+}
+
+// withDefaults returns c with its zero values replaced by their defaults.
+func (c FinderConfig) withDefaults() FinderConfig {
+	defaults := []struct {
+		v   *string
+		def string
+	}{
+		{&c.Type, "auto"},
+		{&c.ZNode, zkPath},
+		{&c.ZKLeaderPrefix, zkLeaderPrefix},
+		{&c.ZKStatuses, "ALIVE"},
+		{&c.ZKEntityFormat, "serverset"},
+	}
+	for _, d := range defaults {
+		if *d.v == "" {
+			*d.v = d.def
+		}
+	}
+
+	if c.ZKSessionTimeout == 0 {
+		c.ZKSessionTimeout = 20 * time.Second
+	}
+	if c.ZKWatchInterval == 0 {
+		c.ZKWatchInterval = time.Second
+	}
+	if c.ZKWatchMaxInterval == 0 {
+		c.ZKWatchMaxInterval = 30 * time.Second
+	}
+	if c.HTTPTimeout == 0 {
+		c.HTTPTimeout = 10 * time.Second
+	}
+	if c.Metrics == nil {
+		c.Metrics = newFinderMetrics()
+	}
+
+	return c
+}
+
+// NewFinder returns the finder for the scheme of c.Address. Unless c.Type is
+// "auto", the finder must be of that type, see finderType.
+func NewFinder(c FinderConfig) (finder, error) {
+	c = c.withDefaults()
+
+	// zk:// and list:// addresses are comma-separated, their first element
+	// carries the scheme.
+	u, err := url.Parse(strings.SplitN(c.Address, ",", 2)[0])
+	if err != nil {
+		return nil, wrapError(ErrBadAddress, "finder: %s", redactError(err))
+	}
+
+	switch c.Type {
+	case "auto", "http", "list", "zk":
+	default:
+		return nil, fmt.Errorf("finder: unknown type %q, must be one of auto, http, list or zk", c.Type)
+	}
+
+	scheme := u.Scheme
+	if scheme == "https" {
+		scheme = "http"
+	}
+	if c.Type != "auto" && c.Type != scheme {
+		return nil, wrapError(ErrBadAddress, "finder: %q is not a %s address", redactURL(c.Address), c.Type)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if c.HTTPRetries < 0 || c.HTTPTimeout <= 0 {
+			return nil, errors.New("httpFinder: retries must not be negative and timeout must be positive")
+		}
+		// The scheme is kept as given, so https schedulers are asked over
+		// https and the scheme of their Location is preserved.
+		return &httpFinder{url: strings.TrimRight(c.Address, "/"), retries: c.HTTPRetries, timeout: c.HTTPTimeout,
+			metrics: c.Metrics}, nil
+	case "list":
+		f, err := newListFinder(c.Address, c.HTTPRetries, c.HTTPTimeout, c.Metrics)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	case "zk":
+		f, err := newZkFinder(c)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	return nil, wrapError(ErrBadAddress, "finder: scheme of %q must be one of http, https, list or zk", redactURL(c.Address))
+}
+
+// unwrapFinder returns the finder doing the actual lookups behind f, for a
+// compositeFinder the one the last leader came from.
+func unwrapFinder(f finder) finder {
+	switch c := f.(type) {
+	case *cachingFinder:
+		return unwrapFinder(c.finder)
+	case *compositeFinder:
+		return unwrapFinder(c.activeFinder())
+	}
+
+	return f
+}
+
+// finderType names the discovery mechanism behind f.
+func finderType(f finder) string {
+	switch unwrapFinder(f).(type) {
+	case *httpFinder:
+		return "http"
+	case *listFinder:
+		return "list"
+	case *zkFinder:
+		return "zk"
+	}
+
+	return "unknown"
+}
+
+// finderPath returns the zNode path the leader of f was found under, if f
+// is backed by ZooKeeper.
+func finderPath(f finder) string {
+	if f, ok := unwrapFinder(f).(*zkFinder); ok {
+		return f.activePath()
+	}
+
+	return ""
+}
+
+// finderZNodes returns the comma-separated zNode paths f looks for the
+// leader under, chroot included, if f is backed by ZooKeeper.
+func finderZNodes(f finder) string {
+	if f, ok := unwrapFinder(f).(*zkFinder); ok {
+		return strings.Join(f.paths, ",")
+	}
+
+	return ""
+}
+
+// redactURL strips the credentials from each element of a comma-separated
+// URL list like the aurora-url, e.g. zk://user:pass@host:2181 becomes
+// zk://host:2181.
+func redactURL(s string) string {
+	parts := strings.Split(s, ",")
+	for i, p := range parts {
+		var scheme string
+		if j := strings.Index(p, "://"); j >= 0 {
+			scheme, p = p[:j+3], p[j+3:]
+		}
+
+		host := p
+		if j := strings.IndexAny(p, "/?#"); j >= 0 {
+			host = p[:j]
+		}
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			p = p[j+1:]
+		}
+
+		parts[i] = scheme + p
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// redactError strips the credentials from the URL of a *url.Error, as
+// returned by url.Parse and http.Client, and returns err.
+func redactError(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		ue.URL = redactURL(ue.URL)
+	}
+
+	return err
 }
 
-func newFinder(url string) (f finder, err error) {
-	if strings.HasPrefix(url, "http://") {
-		f = &httpFinder{url: url}
+// resolveLeader polls f until it resolves a leader or timeout expires. A
+// zkFinder knows no leader until its first watch update, which is waited for
+// first, see waitForFirstLookup.
+func resolveLeader(f finder, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	waitForFirstLookup(ctx, f)
+	for {
+		leader, err := f.leaderURL(ctx)
+		if err == nil || ctx.Err() != nil {
+			return leader, err
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
+}
 
-	if strings.HasPrefix(url, "zk://") {
-		f = newZkFinder(url)
+// waitForFirstLookup waits until ctx is done for a zkFinder behind f to
+// finish its first leader lookup, as the first scrape with a new finder, like
+// that of a probe, would fail otherwise. Later scrapes don't wait, whether or
+// not a leader was found. A finder falling back to another isn't waited for,
+// that would leave the fallback no time.
+func waitForFirstLookup(ctx context.Context, f finder) {
+	if c, ok := f.(*cachingFinder); ok {
+		f = c.finder
 	}
+	if zf, ok := f.(*zkFinder); ok {
+		select {
+		case <-zf.looked:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// leaderDebug is the state of a finder as reported by /debug/leader.
+type leaderDebug struct {
+	Finder       string     `json:"finder"`
+	Leader       string     `json:"leader,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	LastResolved *time.Time `json:"last_resolved,omitempty"`
+	ZNode        string     `json:"znode,omitempty"`
+	Status       string     `json:"status,omitempty"`
+}
+
+func debugLeader(ctx context.Context, f finder) leaderDebug {
+	d := leaderDebug{Finder: finderType(f)}
 
-	if f == nil {
-		err = errors.New("finder: bad address")
+	leader, err := f.leaderURL(ctx)
+	if err != nil {
+		d.Error = err.Error()
 	}
+	d.Leader = leader
 
-	return f, err
+	var resolved time.Time
+	switch f := unwrapFinder(f).(type) {
+	case *httpFinder:
+		resolved = f.lastResolved()
+	case *listFinder:
+		resolved = f.lastResolved()
+	case *zkFinder:
+		f.RLock()
+		resolved = f.updated
+		d.ZNode = f.leaderPath
+		d.Status = f.leader.status
+		f.RUnlock()
+	}
+	if !resolved.IsZero() {
+		d.LastResolved = &resolved
+	}
+
+	return d
 }
 
+// httpRetryDelay is the pause between two leader lookup attempts.
+const httpRetryDelay = 500 * time.Millisecond
+
 type httpFinder struct {
-	url string
+	url     string
+	retries int
+	timeout time.Duration
+	metrics *finderMetrics
+
+	sync.Mutex
+	resolved time.Time
+}
+
+// leaderURL resolves the leader and records when it did.
+func (f *httpFinder) leaderURL(ctx context.Context) (string, error) {
+	leader, err := f.lookup(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	f.Lock()
+	f.resolved = time.Now()
+	f.metrics.setLastUpdate(f.resolved)
+	f.Unlock()
+
+	return leader, nil
 }
 
-func (f *httpFinder) leaderURL() (string, error) {
+// lookup resolves the leader, retrying failed attempts up to f.retries
+// times. Every attempt is bounded by f.timeout and all of them together by
+// the sum of the attempt timeouts, or ctx if it's done sooner.
+func (f *httpFinder) lookup(ctx context.Context) (string, error) {
+	attempts := f.retries + 1
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(attempts)*f.timeout)
+	defer cancel()
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return "", err
+			case <-time.After(httpRetryDelay):
+			}
+		}
+
+		var leader string
+		if leader, err = f.resolve(ctx); err == nil {
+			return leader, nil
+		}
+		finderLog.Debug("leader lookup failed", "attempt", i+1, "attempts", attempts, "err", err)
+	}
+
+	return "", err
+}
+
+// lastResolved returns when the leader was last looked up successfully.
+func (f *httpFinder) lastResolved() time.Time {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.resolved
+}
+
+func (f *httpFinder) resolve(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(withRequestType(ctx, "leader"), f.timeout)
+	defer cancel()
+
 	// This will redirect us to the elected Aurora master
 	schedulerURL := fmt.Sprintf("%s/scheduler", f.url)
-	rr, err := http.NewRequest("GET", schedulerURL, nil)
+	client := currentClient()
+	rr, err := client.newRequest("GET", schedulerURL, nil, false)
 	if err != nil {
 		return "", err
 	}
+	rr = rr.WithContext(ctx)
 
-	rresp, err := httpClient.Transport.RoundTrip(rr)
+	rresp, err := client.http.Transport.RoundTrip(rr)
 	if err != nil {
-		return "", err
+		return "", redactError(err)
 	}
 	defer rresp.Body.Close()
 
-	masterLoc := rresp.Header.Get("Location")
+	// A scheduler that failed to answer isn't the leader, even if it sent
+	// a Location along.
+	if rresp.StatusCode < 200 || rresp.StatusCode >= 400 {
+		return "", fmt.Errorf("httpFinder: %s returned %s", redactURL(schedulerURL), rresp.Status)
+	}
+
+	// Only a redirect points at another scheduler. Without one, the
+	// scheduler we asked is the leader.
+	var masterLoc string
+	if rresp.StatusCode >= 300 {
+		masterLoc = rresp.Header.Get("Location")
+	}
 	if masterLoc == "" {
-		glog.V(6).Info("missing Location header in request")
+		finderLog.Debug("missing Location header in request")
 		masterLoc = schedulerURL
 	}
 
-	return strings.TrimRight(masterLoc, "/scheduler"), nil
+	// Location may be relative or point at another scheme, so resolve it
+	// against the URL we asked.
+	loc, err := rr.URL.Parse(masterLoc)
+	if err != nil {
+		return "", err
+	}
+	loc.RawQuery, loc.Fragment = "", ""
+
+	return strings.TrimSuffix(strings.TrimSuffix(loc.String(), "/"), "/scheduler"), nil
+}
+
+func (f *httpFinder) Close() error {
+	return nil
 }
 
-func hostsFromURL(urls string) (hosts []string, err error) {
+// compositeFinder asks an ordered list of finders for the leader. The first
+// is preferred, the others are only asked once it has failed for longer than
+// after, and until it finds a leader again.
+type compositeFinder struct {
+	sync.Mutex
+	finders []finder
+	after   time.Duration
+	failing time.Time // since when finders[0] fails, zero while it works
+	active  int       // index of the finder the last leader came from
+}
+
+func newCompositeFinder(after time.Duration, finders ...finder) *compositeFinder {
+	return &compositeFinder{finders: finders, after: after}
+}
+
+func (f *compositeFinder) leaderURL(ctx context.Context) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	leader, err := f.finders[0].leaderURL(ctx)
+	if err == nil {
+		if f.active != 0 {
+			finderLog.Info("leader found by the preferred finder again", "finder", finderType(f.finders[0]))
+		}
+		f.failing, f.active = time.Time{}, 0
+		return leader, nil
+	}
+
+	if f.failing.IsZero() {
+		f.failing = time.Now()
+	}
+	if time.Since(f.failing) < f.after {
+		return "", err
+	}
+
+	for i, fb := range f.finders[1:] {
+		leader, ferr := fb.leaderURL(ctx)
+		if ferr != nil {
+			finderLog.Debug("fallback lookup failed", "finder", finderType(fb), "err", ferr)
+			continue
+		}
+
+		if f.active != i+1 {
+			finderLog.Warn("falling back to another finder", "finder", finderType(fb), "err", err)
+		}
+		f.active = i + 1
+		return leader, nil
+	}
+
+	return "", err
+}
+
+// activeFinder returns the finder the last leader came from.
+func (f *compositeFinder) activeFinder() finder {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.finders[f.active]
+}
+
+func (f *compositeFinder) Close() error {
+	var err error
+	for _, c := range f.finders {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// cachingFinder memoizes the leader resolved by another finder for ttl.
+type cachingFinder struct {
+	finder
+	ttl time.Duration
+
+	sync.Mutex
+	leader  string
+	expires time.Time
+}
+
+func newCachingFinder(f finder, ttl time.Duration) *cachingFinder {
+	return &cachingFinder{finder: f, ttl: ttl}
+}
+
+func (f *cachingFinder) leaderURL(ctx context.Context) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.leader != "" && time.Now().Before(f.expires) {
+		return f.leader, nil
+	}
+
+	leader, err := f.finder.leaderURL(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	f.leader, f.expires = leader, time.Now().Add(f.ttl)
+
+	return leader, nil
+}
+
+// invalidate forces the next leaderURL call to resolve the leader again.
+func (f *cachingFinder) invalidate() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.leader = ""
+}
+
+// listFinder finds the leader among a static list of schedulers. The leader
+// is the candidate whose /scheduler doesn't redirect elsewhere.
+type listFinder struct {
+	candidates []*httpFinder
+	metrics    *finderMetrics
+
+	sync.Mutex
+	leader   int
+	resolved time.Time
+}
+
+func newListFinder(urls string, retries int, timeout time.Duration, m *finderMetrics) (*listFinder, error) {
+	if retries < 0 || timeout <= 0 {
+		return nil, errors.New("listFinder: retries must not be negative and timeout must be positive")
+	}
+
+	f := &listFinder{metrics: m}
+	for _, s := range strings.Split(strings.TrimPrefix(urls, "list://"), ",") {
+		s = strings.TrimRight(s, "/")
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "://") {
+			s = "http://" + s
+		}
+
+		f.candidates = append(f.candidates, &httpFinder{url: s, retries: retries, timeout: timeout})
+	}
+
+	if len(f.candidates) == 0 {
+		return nil, errors.New("listFinder: no candidates given")
+	}
+
+	return f, nil
+}
+
+// leaderURL probes the candidates, starting with the last known leader.
+func (f *listFinder) leaderURL(ctx context.Context) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	err := wrapError(ErrNoLeader, "listFinder")
+	for i := range f.candidates {
+		n := (f.leader + i) % len(f.candidates)
+		c := f.candidates[n]
+
+		// Only the candidate found to be the leader counts as an update,
+		// so ask without recording one.
+		leader, lerr := c.lookup(ctx)
+		if lerr != nil {
+			finderLog.Debug("candidate lookup failed", "candidate", redactURL(c.url), "err", lerr)
+			err = lerr
+			continue
+		}
+
+		if sameHost(leader, c.url) {
+			f.leader, f.resolved = n, time.Now()
+			f.metrics.setLastUpdate(f.resolved)
+			return leader, nil
+		}
+	}
+
+	return "", err
+}
+
+// lastResolved returns when a candidate was last found to be the leader.
+func (f *listFinder) lastResolved() time.Time {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.resolved
+}
+
+func (f *listFinder) Close() error {
+	return nil
+}
+
+func sameHost(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return ua.Host == ub.Host
+}
+
+// normalizeZNode returns p with a single leading slash and no trailing or
+// repeated ones, e.g. /aurora/scheduler for aurora/scheduler/.
+func normalizeZNode(p string) string {
+	return path.Clean("/" + p)
+}
+
+// hostsFromURL returns the ZooKeeper servers of a comma-separated
+// zk://host:port list and the chroot path, if any token carries one, as in
+// zk://host1:2181,host2:2181/mesos. Tokens may omit the scheme and be padded
+// with whitespace, empty tokens are skipped.
+func hostsFromURL(urls string) (hosts []string, chroot string, err error) {
+	var bad []string
 	for _, s := range strings.Split(urls, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "://") {
+			s = "zk://" + s
+		}
+
 		u, err := url.Parse(s)
 		if err != nil {
-			return hosts, err
+			return hosts, chroot, redactError(err)
+		}
+
+		if u.Host == "" {
+			bad = append(bad, redactURL(s))
+			continue
 		}
 
 		hosts = append(hosts, u.Host)
+		if chroot == "" && u.Path != "" && u.Path != "/" {
+			chroot = strings.TrimRight(u.Path, "/")
+		}
+	}
+
+	if len(bad) > 0 {
+		return hosts, chroot, fmt.Errorf("zkFinder: no host in %s", strings.Join(bad, ", "))
+	}
+	if len(hosts) == 0 {
+		return hosts, chroot, errors.New("zkFinder: no ZooKeeper hosts given")
 	}
 
-	return hosts, err
+	return hosts, chroot, nil
+}
+
+// zkConn is the part of *zk.Conn zkFinder uses, so the election and watch
+// logic can run against something other than a live ZooKeeper.
+type zkConn interface {
+	AddAuth(scheme string, auth []byte) error
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Close()
+}
+
+var _ zkConn = (*zk.Conn)(nil)
+
+// zkConnect connects to the ZooKeeper servers, it's replaced in tests.
+var zkConnect = func(servers []string, sessionTimeout time.Duration, dialer zk.Dialer, hosts zk.HostProvider) (zkConn, <-chan zk.Event, error) {
+	return zk.Connect(servers, sessionTimeout, zk.WithDialer(dialer), zk.WithHostProvider(hosts))
 }
 
 type zkFinder struct {
-	conn *zk.Conn
+	conn        zkConn
+	paths       []string
+	prefix      string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	done        chan struct{}
+	closeOnce   sync.Once
+	found       chan struct{} // closed once the first leader is known
+	foundOnce   sync.Once
+	looked      chan struct{} // closed once the first lookup finished
+	lookedOnce  sync.Once
+	interval    time.Duration
+	maxInterval time.Duration
+	jitter      float64
+	statuses    map[string]bool
+	endpoint    string
+	decoder     entityDecoder
+	members     map[string]string // candidate zNode to the path it was seen under
+	metrics     *finderMetrics
 
 	sync.RWMutex
-	leaderIP string
+	leader     zkLeader
+	leaderPath string
+	updated    time.Time
+}
+
+// zkLeader is the scheduler endpoint read from a leader zNode.
+type zkLeader struct {
+	scheme   string
+	ip       string
+	port     int
+	status   string
+	noStatus bool // the payload format has no status
 }
 
-func newZkFinder(url string) *zkFinder {
-	zkSrvs, err := hostsFromURL(url)
+// parseZkAuth splits a "scheme:credential" string, e.g. "digest:user:pass".
+func parseZkAuth(auth string) (scheme string, cred []byte, err error) {
+	parts := strings.SplitN(auth, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", nil, errors.New("zkFinder: auth must be of the form scheme:credential")
+	}
+
+	return parts[0], []byte(parts[1]), nil
+}
+
+// newZkFinder watches the leader of the ensemble at c.Address. When
+// c.ZKReadHosts is given, only those servers are connected to, while the
+// chroot is still taken from the address. This keeps load off voting members
+// by reading from observers. c must have its defaults applied.
+func newZkFinder(c FinderConfig) (*zkFinder, error) {
+	if c.ZKSessionTimeout <= 0 {
+		return nil, errors.New("zkFinder: session timeout must be positive")
+	}
+	if c.ZKWatchInterval <= 0 || c.ZKWatchMaxInterval < c.ZKWatchInterval {
+		return nil, errors.New("zkFinder: watch interval must be positive and not exceed the max interval")
+	}
+	if c.ZKWatchJitter < 0 || c.ZKWatchJitter >= 1 {
+		return nil, errors.New("zkFinder: watch jitter must be in [0, 1)")
+	}
+	if c.ZKResolveInterval < 0 {
+		return nil, errors.New("zkFinder: resolve interval must not be negative")
+	}
+	decoder, err := newEntityDecoder(c.ZKEntityFormat)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	conn, events, err := zk.Connect(zkSrvs, 20*time.Second)
+	zkSrvs, chroot, err := hostsFromURL(c.Address)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if c.ZKReadHosts != "" {
+		if zkSrvs, _, err = hostsFromURL(c.ZKReadHosts); err != nil {
+			return nil, err
+		}
 	}
 
-	go func() {
-		for ev := range events {
-			glog.V(6).Infof("conn: %s server: %s", ev.State, ev.Server)
+	var paths []string
+	for _, p := range strings.Split(c.ZNode, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, chroot+normalizeZNode(p))
 		}
-	}()
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("zkFinder: no zNode paths given")
+	}
+
+	hosts := newResolvingHostProvider(c.ZKResolveInterval)
+
+	dialer := zk.Dialer(net.DialTimeout)
+	if c.ZKTLS != nil {
+		dialer = tlsDialer(c.ZKTLS, hosts.serverName)
+	}
+
+	conn, events, err := zkConnect(zkSrvs, c.ZKSessionTimeout, dialer, hosts)
+	if err != nil {
+		return nil, err
+	}
+	c.Metrics.servers.Set(float64(len(zkSrvs)))
+	go watchSession(events, c.Metrics, c.ZKLogEvents)
+
+	if c.ZKAuth != "" {
+		scheme, cred, err := parseZkAuth(c.ZKAuth)
+		if err == nil {
+			err = conn.AddAuth(scheme, cred)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 
-	f := zkFinder{conn: conn}
-	go f.watch()
+	return startZkFinder(conn, paths, decoder, c), nil
+}
+
+// startZkFinder watches the leader under paths through conn, which it owns
+// from then on. c must have its defaults applied.
+func startZkFinder(conn zkConn, paths []string, decoder entityDecoder, c FinderConfig) *zkFinder {
+	accepted := make(map[string]bool)
+	for _, status := range strings.Split(c.ZKStatuses, ",") {
+		accepted[strings.TrimSpace(status)] = true
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := zkFinder{
+		conn:        conn,
+		paths:       paths,
+		prefix:      c.ZKLeaderPrefix,
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		found:       make(chan struct{}),
+		looked:      make(chan struct{}),
+		interval:    c.ZKWatchInterval,
+		maxInterval: c.ZKWatchMaxInterval,
+		jitter:      c.ZKWatchJitter,
+		statuses:    accepted,
+		members:     make(map[string]string),
+		endpoint:    c.LeaderEndpoint,
+		decoder:     decoder,
+		metrics:     c.Metrics,
+	}
+	go f.supervise()
 
 	return &f
 }
 
-func (f *zkFinder) leaderzNode() (string, error) {
-	children, stat, err := f.conn.Children(zkPath)
-	if stat == nil {
-		err = errors.New("zkFinder: children returned nil stat")
+// tlsDialer dials ZooKeeper servers over TLS. The host provider hands out
+// resolved addresses, each connection verifies the server by the host name
+// serverName returns for the address.
+func tlsDialer(cfg *tls.Config, serverName func(addr string) string) zk.Dialer {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		// The settings of newTLSConfig, tls.Config can't be copied.
+		c := &tls.Config{
+			RootCAs:            cfg.RootCAs,
+			Certificates:       cfg.Certificates,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+			ServerName:         serverName(address),
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, c)
 	}
-	if err != nil {
-		return "", err
+}
+
+// watchSession tracks the session state in m and, if logEvents is set, logs
+// the connection events. It drains events either way until the connection is
+// closed: the zk library drops events when the channel is full, which would
+// leave aurora_zk_connected stale.
+func watchSession(events <-chan zk.Event, m *finderMetrics, logEvents bool) {
+	var server string
+	setServer := func(s string) {
+		if s != server && server != "" {
+			m.currentServer.DeleteLabelValues(server)
+		}
+		if server = s; server != "" {
+			m.currentServer.WithLabelValues(server).Set(1)
+		}
 	}
 
+	defer func() {
+		m.connected.Set(0)
+		setServer("")
+	}()
+
+	for ev := range events {
+		if logEvents {
+			finderLog.Debug("zk connection event", "state", ev.State, "server", ev.Server)
+		}
+
+		if ev.Type != zk.EventSession {
+			continue
+		}
+		// The zk library reconnects with a new session and resends the
+		// auth on its own, the watch loop then sets new watches.
+		if ev.State == zk.StateExpired {
+			m.sessionExpirations.Inc()
+			finderLog.Warn("zk session expired, reconnecting", "server", ev.Server)
+		}
+		if ev.State == zk.StateHasSession {
+			m.connected.Set(1)
+			setServer(ev.Server)
+		} else {
+			m.connected.Set(0)
+			setServer("")
+		}
+	}
+}
+
+// leaderzNode returns the zNode of the leader candidate under path and a
+// watch firing when the candidates under path change. The watch is set even
+// if there is no leader, as long as path exists.
+func (f *zkFinder) leaderzNode(path string) (string, <-chan zk.Event, error) {
+	// The candidates of a path that can't be listed are no longer known,
+	// so their series are dropped.
+	children, stat, events, err := f.conn.ChildrenW(path)
+	switch {
+	case err != nil:
+		f.metrics.watchErrors.WithLabelValues("children").Inc()
+		f.setMembers(path, nil, "")
+		return "", nil, err
+	case stat == nil:
+		f.metrics.watchErrors.WithLabelValues("nil_stat").Inc()
+		f.setMembers(path, nil, "")
+		return "", events, errors.New("zkFinder: children returned nil stat")
+	}
+
+	// The candidate with the lowest sequence number holds the leadership,
+	// children without the prefix are not candidates. A candidate without a
+	// valid sequence is skipped rather than failing the election.
 	var leaderSeq int
 	var leader string
+	seqs := make(map[string]int)
 	for _, child := range children {
-		path := strings.Split(child, zkLeaderPrefix)
-		if len(path) > 1 {
-			seq, err := strconv.Atoi(path[1])
+		if strings.HasPrefix(child, f.prefix) {
+			seq, err := strconv.Atoi(strings.TrimPrefix(child, f.prefix))
 			if err != nil {
-				return "", err
-			}
-
-			if leader == "" {
-				leader = child
+				f.metrics.watchErrors.WithLabelValues("sequence").Inc()
+				finderLog.Warn("skipping candidate with a bad sequence", "path", path, "child", child)
+				continue
 			}
+			seqs[child] = seq
 
-			if seq <= leaderSeq {
+			if leader == "" || seq < leaderSeq {
 				leaderSeq = seq
 				leader = child
 			}
 		}
 	}
+	f.setMembers(path, seqs, leader)
 
 	if leader == "" {
-		return leader, errors.New("zkFinder: zNode not found")
+		f.metrics.watchErrors.WithLabelValues("not_found").Inc()
+		return leader, events, wrapError(ErrZNodeNotFound, "zkFinder: %s", path)
+	}
+
+	return fmt.Sprintf("%s/%s", path, leader), events, nil
+}
+
+// setMembers exports the candidates seen under path and drops those that
+// have gone since the previous lookup.
+func (f *zkFinder) setMembers(path string, seqs map[string]int, leader string) {
+	for member, p := range f.members {
+		if _, ok := seqs[member]; p == path && !ok {
+			f.metrics.memberSequence.DeleteLabelValues(member)
+			f.metrics.memberElected.DeleteLabelValues(member)
+			delete(f.members, member)
+		}
 	}
 
-	return fmt.Sprintf("%s/%s", zkPath, leader), nil
+	for member, seq := range seqs {
+		f.members[member] = path
+		f.metrics.memberSequence.WithLabelValues(member).Set(float64(seq))
+		if member == leader {
+			f.metrics.memberElected.WithLabelValues(member).Set(1)
+		} else {
+			f.metrics.memberElected.WithLabelValues(member).Set(0)
+		}
+	}
 }
 
-func (f *zkFinder) leaderURL() (string, error) {
+// leaderURL returns the leader the watch found last, without waiting.
+func (f *zkFinder) leaderURL(ctx context.Context) (string, error) {
 	f.RLock()
 	defer f.RUnlock()
 
-	if f.leaderIP == "" {
-		return "", errors.New("zkFinder: no leader found via ZooKeeper")
+	if f.leader.ip == "" {
+		return "", wrapError(ErrNoLeader, "zkFinder")
 	}
 
-	return fmt.Sprintf("http://%s:8081", f.leaderIP), nil
+	// JoinHostPort brackets IPv6 literals.
+	host := net.JoinHostPort(f.leader.ip, strconv.Itoa(f.leader.port))
+
+	return fmt.Sprintf("%s://%s", f.leader.scheme, host), nil
 }
 
-func (f *zkFinder) watch() {
-	for _ = range time.NewTicker(1 * time.Second).C {
-		zNode, err := f.leaderzNode()
-		if err != nil {
-			glog.Warning(err)
-			continue
+// activePath returns the zNode path the current leader was found under.
+func (f *zkFinder) activePath() string {
+	f.RLock()
+	defer f.RUnlock()
+
+	return f.leaderPath
+}
+
+func (f *zkFinder) setLeader(leader zkLeader, path string) {
+	f.Lock()
+	defer f.Unlock()
+
+	// The first leader found isn't a transition, nor is a reread of the
+	// same one.
+	if f.leader.ip != "" && (f.leader.ip != leader.ip || f.leader.port != leader.port) {
+		f.metrics.transitions.Inc()
+	}
+	f.leader = leader
+	f.leaderPath = path
+	f.updated = time.Now()
+	f.metrics.setLastUpdate(f.updated)
+
+	f.foundOnce.Do(func() { close(f.found) })
+}
+
+// waitForLeader blocks until the first leader is known or ctx is done.
+func (f *zkFinder) waitForLeader(ctx context.Context) error {
+	select {
+	case <-f.found:
+		return nil
+	case <-ctx.Done():
+		return wrapError(ErrNoLeader, "zkFinder: %s", ctx.Err())
+	}
+}
+
+// parseLeader decodes a zNode payload and checks the status of the leader
+// against the accepted ones. Leaders of formats without a status, like bare
+// host:port payloads, are always accepted. An entity with an empty status is
+// only accepted if the empty status is, as by -zk.accepted-statuses=ALIVE,
+// with a trailing comma.
+func (f *zkFinder) parseLeader(payload string) (zkLeader, error) {
+	leader, err := f.decoder.decode(payload, f.endpoint)
+	if err != nil {
+		f.metrics.watchErrors.WithLabelValues("unmarshal").Inc()
+		return zkLeader{}, err
+	}
+
+	if !leader.noStatus && !f.statuses[leader.status] {
+		f.metrics.leaderRejected.WithLabelValues(leader.status).Inc()
+		return zkLeader{}, fmt.Errorf("zkFinder: leader status %q not accepted, keeping previous leader", leader.status)
+	}
+
+	return leader, nil
+}
+
+// watchRestartDelay is the pause before the watch loop restarts after a
+// panic, so a panic on every iteration doesn't spin.
+const watchRestartDelay = 5 * time.Second
+
+// supervise runs the watch loop until the finder is closed, restarting it
+// after a panic.
+func (f *zkFinder) supervise() {
+	defer close(f.done)
+
+	for f.watch() {
+		f.metrics.watchRestarts.Inc()
+
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-time.After(watchRestartDelay):
+		}
+	}
+}
+
+// watch looks up the leader until the finder is closed. It reports whether
+// it stopped on a panic instead, which is logged.
+func (f *zkFinder) watch() (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			finderLog.Error("leader watch panicked, restarting", "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			panicked = true
 		}
+	}()
+
+	b := backoff{
+		base:   f.interval,
+		max:    f.maxInterval,
+		jitter: f.jitter,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	timer := time.NewTimer(b.next(false))
+	defer timer.Stop()
 
-		glog.V(6).Info("leader zNode at: ", zNode)
+	log := &repeatLogger{logger: finderLog, every: 30}
 
-		data, stat, events, err := f.conn.GetW(zNode)
-		if stat == nil {
-			err = errors.New("get returned nil stat")
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-timer.C:
 		}
-		if err != nil {
-			glog.Warning(err)
+
+		watches, err := f.update()
+		f.lookedOnce.Do(func() { close(f.looked) })
+		if err == nil {
+			log.recovered("leader lookup recovered")
+
+			if err := f.wait(watches, nil); err != nil {
+				finderLog.Warn("leader watch failed", "err", err)
+			}
+			timer.Reset(b.next(false))
 			continue
 		}
 
-		f.Lock()
-		f.leaderIP = string(data)
-		f.Unlock()
+		log.Warn("leader lookup failed", "err", err)
 
-		for ev := range events {
-			switch {
-			case ev.Err != nil:
-				err = fmt.Errorf("watcher error %+v", ev.Err)
-			case ev.Type == zk.EventNodeDeleted:
-				err = errors.New("leader zNode deleted")
+		// The watches set before the lookup failed are waited for along
+		// with the backoff, so a leader turning up is looked up right away.
+		timer.Reset(b.next(true))
+		if err := f.wait(watches, timer.C); err != nil {
+			finderLog.Warn("leader watch failed", "err", err)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
+		}
+		timer.Reset(0)
+	}
+}
 
-			if err != nil {
-				glog.Warning(err)
-				break
+// update reads the current leader from ZooKeeper and returns the watches on
+// its zNode and the candidates. On error, it returns the watches set so far.
+func (f *zkFinder) update() ([]<-chan zk.Event, error) {
+	// The paths are tried in order of priority. The candidates of those
+	// tried are watched, so the leader is looked up again once they change,
+	// e.g. when a path of higher priority gets a leader.
+	var path, zNode string
+	var err error
+	var watches []<-chan zk.Event
+	for _, path = range f.paths {
+		var children <-chan zk.Event
+		zNode, children, err = f.leaderzNode(path)
+		if children != nil {
+			watches = append(watches, children)
+		}
+		if err == nil {
+			break
+		}
+		finderLog.Debug("no leader found", "path", path, "err", err)
+	}
+	if err != nil {
+		return watches, err
+	}
+
+	finderLog.Debug("leader zNode found", "zNode", zNode)
+
+	data, stat, events, err := f.conn.GetW(zNode)
+	if events != nil {
+		watches = append(watches, events)
+	}
+	switch {
+	case err != nil:
+		f.metrics.watchErrors.WithLabelValues("get").Inc()
+		return watches, err
+	case stat == nil:
+		f.metrics.watchErrors.WithLabelValues("nil_stat").Inc()
+		return watches, errors.New("get returned nil stat")
+	}
+
+	payload := strings.TrimPrefix(string(data), SOH)
+	if payload == "" {
+		f.metrics.watchErrors.WithLabelValues("soh").Inc()
+		return watches, errors.New("leader zNode data is empty or SOH, keeping previous leader")
+	}
+
+	leader, err := f.parseLeader(payload)
+	if err != nil {
+		return watches, err
+	}
+
+	f.setLeader(leader, path)
+	f.metrics.leaderMtime.Set(float64(stat.Mtime) / 1e3)
+	f.metrics.leaderVersion.Set(float64(stat.Version))
+
+	return watches, nil
+}
+
+// wait blocks until one of the watches on the leader zNode or the candidates
+// fires, timeout fires or the finder is closed.
+func (f *zkFinder) wait(watches []<-chan zk.Event, timeout <-chan time.Time) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	// A watch fires once, a closed one is passed on as no longer watching.
+	fired := make(chan zk.Event, len(watches))
+	for _, w := range watches {
+		go func(w <-chan zk.Event) {
+			select {
+			case ev, ok := <-w:
+				if !ok {
+					ev = zk.Event{Type: zk.EventNotWatching}
+				}
+				fired <- ev
+			case <-done:
 			}
+		}(w)
+	}
+
+	select {
+	case <-f.ctx.Done():
+		return nil
+	case <-timeout:
+		return nil
+	case ev := <-fired:
+		switch {
+		case ev.Err != nil:
+			f.metrics.watchErrors.WithLabelValues("watcher").Inc()
+			return fmt.Errorf("watcher error %+v", ev.Err)
+		case ev.Type == zk.EventNodeDeleted:
+			f.metrics.watchErrors.WithLabelValues("node_deleted").Inc()
+			return fmt.Errorf("zNode %s deleted", ev.Path)
+		case ev.Type == zk.EventNodeChildrenChanged:
+			finderLog.Debug("leader candidates changed", "path", ev.Path)
+		}
+	}
+
+	return nil
+}
+
+// backoff doubles the delay after each consecutive failure, up to max, and
+// falls back to base after a success. Every delay is randomly spread by up
+// to the jitter fraction in either direction.
+type backoff struct {
+	base, max, cur time.Duration
+	jitter         float64
+	rnd            *rand.Rand
+}
+
+func (b *backoff) next(failed bool) time.Duration {
+	switch {
+	case !failed || b.cur == 0:
+		b.cur = b.base
+	case b.cur < b.max:
+		b.cur *= 2
+		if b.cur > b.max {
+			b.cur = b.max
 		}
 	}
+
+	if b.jitter == 0 {
+		return b.cur
+	}
+
+	return time.Duration(float64(b.cur) * (1 + b.jitter*(2*b.rnd.Float64()-1)))
+}
+
+// Close stops the watch loop and closes the ZooKeeper connection. It returns
+// once the watch loop exited.
+func (f *zkFinder) Close() error {
+	f.closeOnce.Do(func() {
+		f.cancel()
+		f.conn.Close()
+		<-f.done
+
+		for member := range f.members {
+			f.metrics.memberSequence.DeleteLabelValues(member)
+			f.metrics.memberElected.DeleteLabelValues(member)
+		}
+	})
+
+	return nil
 }
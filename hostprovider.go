@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolvingHostProvider is a zk.HostProvider like the default one, except
+// that it resolves the server names again once it went through all their
+// addresses without connecting, if the last resolution is older than
+// interval. ZooKeeper servers behind DNS names whose addresses change are
+// then found again. An interval of 0 never resolves again.
+type resolvingHostProvider struct {
+	interval   time.Duration
+	lookupHost func(host string) ([]string, error)
+
+	sync.Mutex
+	servers  []string          // host:port as given
+	addrs    []string          // ip:port in random order
+	names    map[string]string // ip:port to the host it was resolved from
+	curr     int
+	last     int // index of the address last connected to, -1 before
+	resolved time.Time
+}
+
+func newResolvingHostProvider(interval time.Duration) *resolvingHostProvider {
+	return &resolvingHostProvider{interval: interval, lookupHost: net.LookupHost}
+}
+
+func (p *resolvingHostProvider) Init(servers []string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.servers = servers
+
+	return p.resolve()
+}
+
+// resolve looks up the addresses of the servers. Servers whose name doesn't
+// resolve are skipped, if none does the addresses are left as they are.
+func (p *resolvingHostProvider) resolve() error {
+	p.resolved = time.Now()
+
+	var found []string
+	names := make(map[string]string)
+	for _, server := range p.servers {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			return err
+		}
+
+		addrs, err := p.lookupHost(host)
+		if err != nil {
+			finderLog.Warn("zk server not resolved", "server", server, "err", err)
+			continue
+		}
+		for _, addr := range addrs {
+			addr = net.JoinHostPort(addr, port)
+			found = append(found, addr)
+			names[addr] = host
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("zkFinder: no addresses found for %s", strings.Join(p.servers, ", "))
+	}
+
+	// Spread the clients over the servers.
+	for i, j := range rand.Perm(len(found)) {
+		found[i], found[j] = found[j], found[i]
+	}
+	p.addrs, p.names, p.curr, p.last = found, names, -1, -1
+
+	return nil
+}
+
+// serverName returns the host name addr was resolved from, or the host of
+// addr if it wasn't.
+func (p *resolvingHostProvider) serverName(addr string) string {
+	p.Lock()
+	defer p.Unlock()
+
+	if name, ok := p.names[addr]; ok {
+		return name
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+func (p *resolvingHostProvider) Len() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return len(p.addrs)
+}
+
+// Next returns the next address to connect to. retryStart is true once all
+// of them were tried since the last connection.
+func (p *resolvingHostProvider) Next() (server string, retryStart bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.curr = (p.curr + 1) % len(p.addrs)
+	retryStart = p.curr == p.last
+	if p.last == -1 {
+		p.last = 0
+	}
+
+	if retryStart && p.interval > 0 && time.Since(p.resolved) >= p.interval {
+		before := strings.Join(p.addrs, ",")
+		if err := p.resolve(); err != nil {
+			finderLog.Warn("zk servers not resolved again, keeping their addresses", "err", err)
+		} else {
+			finderLog.Info("zk servers resolved again", "before", before, "after", strings.Join(p.addrs, ","))
+			p.curr, p.last = 0, 0
+		}
+	}
+
+	return p.addrs[p.curr], retryStart
+}
+
+func (p *resolvingHostProvider) Connected() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.last = p.curr
+}
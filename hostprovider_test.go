@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLookup resolves host names from a map.
+type fakeLookup map[string][]string
+
+func (l fakeLookup) lookupHost(host string) ([]string, error) {
+	if addrs, ok := l[host]; ok {
+		return addrs, nil
+	}
+
+	return nil, errors.New("no such host " + host)
+}
+
+func TestResolvingHostProviderServerName(t *testing.T) {
+	p := newResolvingHostProvider(0)
+	p.lookupHost = fakeLookup{"zk1": {"10.0.0.1", "10.0.0.2"}, "zk2": {"10.0.0.3"}}.lookupHost
+	if err := p.Init([]string{"zk1:2181", "zk2:2182", "missing:2181"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var addrs []string
+	for i := 0; i < p.Len(); i++ {
+		addr, _ := p.Next()
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	if got, want := strings.Join(addrs, ","), "10.0.0.1:2181,10.0.0.2:2181,10.0.0.3:2182"; got != want {
+		t.Errorf("addresses are %s, want %s", got, want)
+	}
+
+	tests := map[string]string{
+		"10.0.0.1:2181": "zk1",
+		"10.0.0.2:2181": "zk1",
+		"10.0.0.3:2182": "zk2",
+		"10.0.0.9:2181": "10.0.0.9",
+	}
+	for addr, want := range tests {
+		if got := p.serverName(addr); got != want {
+			t.Errorf("server name of %s is %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestResolvingHostProviderResolvesAgain(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Nanosecond} {
+		lookup := fakeLookup{"zk1": {"10.0.0.1"}}
+		p := newResolvingHostProvider(interval)
+		p.lookupHost = lookup.lookupHost
+		if err := p.Init([]string{"zk1:2181"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if addr, retryStart := p.Next(); addr != "10.0.0.1:2181" || retryStart {
+			t.Fatalf("got %s, %t first", addr, retryStart)
+		}
+		lookup["zk1"] = []string{"10.0.0.5"}
+
+		// Another round without connecting resolves the names again.
+		addr, retryStart := p.Next()
+		if !retryStart {
+			t.Error("the second round isn't a retry start")
+		}
+		want := map[time.Duration]string{0: "10.0.0.1:2181", time.Nanosecond: "10.0.0.5:2181"}[interval]
+		if addr != want {
+			t.Errorf("with interval %s got %s after a failed round, want %s", interval, addr, want)
+		}
+	}
+}
+
+func TestResolvingHostProviderKeepsAddressesUnresolved(t *testing.T) {
+	lookup := fakeLookup{"zk1": {"10.0.0.1"}}
+	p := newResolvingHostProvider(time.Nanosecond)
+	p.lookupHost = lookup.lookupHost
+	if err := p.Init([]string{"zk1:2181"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Next()
+	delete(lookup, "zk1")
+	if addr, _ := p.Next(); addr != "10.0.0.1:2181" {
+		t.Errorf("got %s, want the address from before the failed resolution", addr)
+	}
+	if err := newResolvingHostProvider(0).Init([]string{"zk1"}); err == nil {
+		t.Error("a server without port was accepted")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// reservedLabels are the label names the exported metrics use themselves,
+// including le and quantile of histograms and summaries. The cluster label
+// is only used with -exporter.cluster, see checkClusterLabel.
+var reservedLabels = map[string]bool{
+	"branch": true, "code": true, "env": true, "finder": true, "goversion": true,
+	"host": true, "job": true, "le": true, "member": true, "path": true, "quantile": true, "rack": true,
+	"reason": true, "revision": true, "role": true, "state": true, "status": true, "type": true,
+	"version": true, "znode": true,
+}
+
+// labelFlag collects the repeatable -label key=value flag.
+type labelFlag prometheus.Labels
+
+func (l labelFlag) String() string {
+	var pairs []string
+	for k, v := range l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func (l labelFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("label %q must be key=value", s)
+	}
+
+	k, v := parts[0], parts[1]
+	_, dup := l[k]
+	switch {
+	case !labelNameRE.MatchString(k) || strings.HasPrefix(k, "__"):
+		return fmt.Errorf("invalid label name %q", k)
+	case reservedLabels[k]:
+		return fmt.Errorf("label name %q is used by the exporter", k)
+	case dup:
+		return fmt.Errorf("label %q given twice", k)
+	}
+	l[k] = v
+
+	return nil
+}
+
+// checkClusterLabel rejects a cluster label among labels if the clusters
+// label their metrics with it.
+func checkClusterLabel(labels labelFlag, clusters *clusterFlag) error {
+	if _, ok := labels[clusterLabel]; ok && len(clusters.names) > 0 {
+		return fmt.Errorf("label name %q is used by -exporter.cluster", clusterLabel)
+	}
+
+	return nil
+}
+
+// labeledCollector adds constant labels to every metric c collects.
+type labeledCollector struct {
+	c      prometheus.Collector
+	labels []*dto.LabelPair
+}
+
+// withLabels returns c with labels attached, or c itself if there are none.
+func withLabels(c prometheus.Collector, labels prometheus.Labels) prometheus.Collector {
+	if len(labels) == 0 {
+		return c
+	}
+
+	l := &labeledCollector{c: c}
+	for k, v := range labels {
+		l.labels = append(l.labels, &dto.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+	}
+
+	return l
+}
+
+func (l *labeledCollector) Describe(ch chan<- *prometheus.Desc) {
+	l.c.Describe(ch)
+}
+
+func (l *labeledCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		l.c.Collect(metrics)
+		close(metrics)
+	}()
+
+	for m := range metrics {
+		ch <- labeledMetric{m, l.labels}
+	}
+}
+
+type labeledMetric struct {
+	prometheus.Metric
+	labels []*dto.LabelPair
+}
+
+func (m labeledMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+
+	out.Label = append(out.Label, m.labels...)
+	sort.Sort(prometheus.LabelPairSorter(out.Label))
+
+	return nil
+}
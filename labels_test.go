@@ -0,0 +1,88 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var variableLabelsRE = regexp.MustCompile(`variableLabels: \[([^\]]*)\]`)
+
+// TestReservedLabelsCoverDescs guards reservedLabels against metrics added
+// with new label names.
+func TestReservedLabelsCoverDescs(t *testing.T) {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		for _, c := range []prometheus.Collector{NewCollector(nil, CollectorOpts{}), buildInfo, schedulerRequests} {
+			c.Describe(ch)
+		}
+		ch <- targetInfoDesc
+		close(ch)
+	}()
+
+	for d := range ch {
+		m := variableLabelsRE.FindStringSubmatch(d.String())
+		if m == nil {
+			t.Fatalf("no variable labels in %s", d)
+		}
+		for _, name := range strings.Fields(m[1]) {
+			if !reservedLabels[name] {
+				t.Errorf("label %q of %s isn't reserved", name, metricFQName(d))
+			}
+		}
+	}
+}
+
+func TestLabelFlag(t *testing.T) {
+	l := labelFlag{}
+	if err := l.Set("dc=east"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("az=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.String(); got != "az=1,dc=east" {
+		t.Errorf("labels are %q", got)
+	}
+
+	for _, s := range []string{"dc=west", "nolabel", "1dc=x", "__name=x", "le=1", "code=200", "znode=/x"} {
+		if err := l.Set(s); err == nil {
+			t.Errorf("label %q accepted", s)
+		}
+	}
+}
+
+func TestWithLabels(t *testing.T) {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "g", Help: "g"}, []string{"state"})
+	g.WithLabelValues("ACTIVE").Set(1)
+
+	got := collect(t, withLabels(g, prometheus.Labels{"cluster": "east", "dc": "x"}))
+	if got[`g{cluster="east",dc="x",state="ACTIVE"}`] != 1 {
+		t.Errorf("got %v", got)
+	}
+
+	if withLabels(g, nil) != prometheus.Collector(g) {
+		t.Error("collector without labels is wrapped")
+	}
+}
+
+func TestCheckClusterLabel(t *testing.T) {
+	labels := labelFlag{}
+	if err := labels.Set("cluster=east"); err != nil {
+		t.Fatalf("cluster label without -exporter.cluster rejected: %v", err)
+	}
+	clusters := &clusterFlag{urls: make(map[string]string)}
+	if err := checkClusterLabel(labels, clusters); err != nil {
+		t.Errorf("cluster label without -exporter.cluster rejected: %v", err)
+	}
+
+	clusters.Set("west=http://west:8081")
+	if err := checkClusterLabel(labels, clusters); err == nil {
+		t.Error("cluster label accepted along with -exporter.cluster")
+	}
+	if err := checkClusterLabel(labelFlag{"dc": "x"}, clusters); err != nil {
+		t.Errorf("got %v for labels without cluster", err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// logger is a leveled logger taking alternating key-value pairs after the
+// message.
+type logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// finderLog is used by all finders.
+var finderLog logger = glogLogger{}
+
+// glogLogger logs through glog, with debug messages at verbosity 6 unless
+// debug is set.
+type glogLogger struct {
+	debug bool
+}
+
+func (l glogLogger) Debug(msg string, keyvals ...interface{}) {
+	if l.debug {
+		glog.Info(logLine(msg, keyvals))
+		return
+	}
+	glog.V(6).Info(logLine(msg, keyvals))
+}
+
+func (glogLogger) Info(msg string, keyvals ...interface{}) {
+	glog.Info(logLine(msg, keyvals))
+}
+
+func (glogLogger) Warn(msg string, keyvals ...interface{}) {
+	glog.Warning(logLine(msg, keyvals))
+}
+
+func (glogLogger) Error(msg string, keyvals ...interface{}) {
+	glog.Error(logLine(msg, keyvals))
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	}
+
+	return 0, fmt.Errorf("unknown log level %q, must be one of debug, info, warn or error", s)
+}
+
+// levelLogger drops the messages below level. Debug messages also pass at
+// glog verbosity 6, as before there were levels.
+type levelLogger struct {
+	logger
+	level logLevel
+}
+
+func (l levelLogger) Debug(msg string, keyvals ...interface{}) {
+	if l.level <= levelDebug || glog.V(6) {
+		l.logger.Debug(msg, keyvals...)
+	}
+}
+
+func (l levelLogger) Info(msg string, keyvals ...interface{}) {
+	if l.level <= levelInfo {
+		l.logger.Info(msg, keyvals...)
+	}
+}
+
+func (l levelLogger) Warn(msg string, keyvals ...interface{}) {
+	if l.level <= levelWarn {
+		l.logger.Warn(msg, keyvals...)
+	}
+}
+
+func (l levelLogger) Error(msg string, keyvals ...interface{}) {
+	if l.level <= levelError {
+		l.logger.Error(msg, keyvals...)
+	}
+}
+
+func logLine(msg string, keyvals []interface{}) string {
+	var b bytes.Buffer
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], logValue(keyvals, i+1))
+	}
+
+	return b.String()
+}
+
+func logValue(keyvals []interface{}, i int) interface{} {
+	if i >= len(keyvals) {
+		return "MISSING"
+	}
+
+	return keyvals[i]
+}
+
+// repeatLogger collapses identical consecutive warnings: the first one is
+// logged, then only every nth repetition along with the count.
+type repeatLogger struct {
+	logger
+	every int
+
+	last  string
+	count int
+}
+
+func (l *repeatLogger) Warn(msg string, keyvals ...interface{}) {
+	line := logLine(msg, keyvals)
+	if line != l.last {
+		l.last, l.count = line, 0
+		l.logger.Warn(msg, keyvals...)
+		return
+	}
+
+	l.count++
+	if l.count%l.every == 0 {
+		l.logger.Warn(msg, append(keyvals, "repeated", l.count)...)
+	}
+}
+
+// recovered ends a run of warnings, logging how many were suppressed.
+func (l *repeatLogger) recovered(msg string) {
+	if l.last == "" {
+		return
+	}
+
+	l.logger.Info(msg, "repeated", l.count)
+	l.last, l.count = "", 0
+}
+
+// jsonLogger writes one JSON object per line.
+type jsonLogger struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONLogger(w io.Writer) *jsonLogger {
+	return &jsonLogger{enc: json.NewEncoder(w)}
+}
+
+func (l *jsonLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log("debug", msg, keyvals)
+}
+
+func (l *jsonLogger) Info(msg string, keyvals ...interface{}) {
+	l.log("info", msg, keyvals)
+}
+
+func (l *jsonLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log("warn", msg, keyvals)
+}
+
+func (l *jsonLogger) Error(msg string, keyvals ...interface{}) {
+	l.log("error", msg, keyvals)
+}
+
+func (l *jsonLogger) log(level, msg string, keyvals []interface{}) {
+	m := map[string]interface{}{
+		"ts":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level,
+		"msg":   msg,
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		v := logValue(keyvals, i+1)
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		m[fmt.Sprint(keyvals[i])] = v
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.enc.Encode(m)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// recordingLogger keeps the messages logged, prefixed by their level.
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) {
+	l.lines = append(l.lines, "debug "+logLine(msg, keyvals))
+}
+
+func (l *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	l.lines = append(l.lines, "info "+logLine(msg, keyvals))
+}
+
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{}) {
+	l.lines = append(l.lines, "warn "+logLine(msg, keyvals))
+}
+
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) {
+	l.lines = append(l.lines, "error "+logLine(msg, keyvals))
+}
+
+func TestLevelLogger(t *testing.T) {
+	tests := map[string]string{
+		"debug": "debug d,info i,warn w,error e",
+		"info":  "info i,warn w,error e",
+		"warn":  "warn w,error e",
+		"error": "error e",
+	}
+
+	for name, want := range tests {
+		level, err := parseLogLevel(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := &recordingLogger{}
+		l := levelLogger{logger: r, level: level}
+		l.Debug("d")
+		l.Info("i")
+		l.Warn("w")
+		l.Error("e")
+
+		if got := strings.Join(r.lines, ","); got != want {
+			t.Errorf("level %s logged %q, want %q", name, got, want)
+		}
+	}
+
+	if _, err := parseLogLevel("trace"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestLogLine(t *testing.T) {
+	if got, want := logLine("msg", []interface{}{"a", 1, "b"}), "msg a=1 b=MISSING"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := newJSONLogger(&b)
+	l.Warn("leader lookup failed", "err", errors.New("boom"), "attempt", 2)
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["level"] != "warn" || m["msg"] != "leader lookup failed" || m["err"] != "boom" || m["attempt"] != 2.0 || m["ts"] == nil {
+		t.Errorf("got %v", m)
+	}
+}
+
+func TestRepeatLogger(t *testing.T) {
+	r := &recordingLogger{}
+	l := &repeatLogger{logger: r, every: 2}
+	for i := 0; i < 5; i++ {
+		l.Warn("failed")
+	}
+	l.recovered("recovered")
+	l.recovered("recovered")
+
+	want := "warn failed,warn failed repeated=2,warn failed repeated=4,info recovered repeated=4"
+	if got := strings.Join(r.lines, ","); got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
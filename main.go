@@ -1,49 +1,185 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	neturl "net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 )
 
 const namespace = "aurora"
 
 var (
-	addr           = flag.String("web.listen-address", ":9113", "Address to listen on for web interface and telemetry.")
+	configFile     = flag.String("config.file", "", "YAML file to read settings from, flags take precedence.")
+	addr           = flag.String("web.listen-address", ":9113", "Address to listen on for web interface and telemetry, or unix:/path/to.sock.")
 	auroraURL      = flag.String("exporter.aurora-url", "http://127.0.0.1:8081", "URL to an Aurora scheduler or ZooKeeper ensemble")
 	metricPath     = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	shutdownWait   = flag.Duration("web.shutdown-timeout", 10*time.Second, "How long in-flight requests may take on shutdown.")
 	bypassRedirect = flag.Bool("exporter.bypass-leader-redirect", false,
 		"When scraping a HTTP scheduler url, don't follow redirects to the leader instance.")
+	unknownVars = flag.Bool("exporter.unknown-vars", false,
+		"Export vars without a known metric, typed by their name suffix.")
+	noLeaderOK = flag.Bool("exporter.no-leader-ok", false,
+		"Count scrapes while there is no leader as successful, exporting no scheduler metrics.")
+	scrapeTimeout = flag.Duration("scrape.timeout", 10*time.Second,
+		"Timeout of the scheduler requests of a scrape, lowered to the Prometheus scrape timeout if shorter.")
+	scrapeTimeoutOffset = flag.Duration("scrape.timeout-offset", 500*time.Millisecond,
+		"Time subtracted from the Prometheus scrape timeout to leave for sending the response.")
+	varsPath = flag.String("scrape.path", "/vars",
+		"Path of the scheduler stats, read as JSON if served as application/json, else as key value lines as by /vars.")
+	scrapeRetries = flag.Int("scrape.retries", 2,
+		"Number of times a scheduler request answered with 502, 503 or 504 is retried within the scrape timeout.")
+	breakerFailures = flag.Int("scrape.breaker-failures", 0,
+		"Consecutive failed scrapes after which the scheduler isn't scraped for the cooldown, 0 disables this.")
+	breakerCooldown = flag.Duration("scrape.breaker-cooldown", 30*time.Second,
+		"How long the scheduler isn't scraped after too many failed scrapes.")
+	scrapeConcurrency = flag.Int("scrape.concurrency", 0, "Number of clusters scraped at once, 0 means all.")
+	serveStale        = flag.Duration("scrape.serve-stale", 0,
+		"How long the metrics of the last successful scrape are served in place of those of failed scrapes, 0 disables this.")
+	probeMaxTargets = flag.Int("probe.max-targets", 100,
+		"Number of probe targets whose finders are kept, the least recently probed is closed beyond that, 0 means no limit.")
+	finderKind         = flag.String("finder.type", "auto", "Type of finder the aurora-url must be for, auto, http, list or zk.")
+	fallbackURL        = flag.String("finder.fallback-url", "", "URL to find the leader at while the aurora-url fails to.")
+	fallbackAfter      = flag.Duration("finder.fallback-after", 30*time.Second, "How long the aurora-url must fail before the fallback-url is used.")
+	zkZnode            = flag.String("zk.znode", zkPath, "Comma-separated zNode paths to look for the leader under, in order of priority.")
+	zkPrefix           = flag.String("zk.leader-prefix", zkLeaderPrefix, "Name prefix of the leader candidate zNodes.")
+	zkStatuses         = flag.String("zk.accepted-statuses", "ALIVE", "Comma-separated leader entity statuses that are accepted, an empty one accepts entities without a status.")
+	zkFormat           = flag.String("zk.entity-format", "serverset", "Format of the leader zNode payload, serverset or hostport.")
+	zkAuth             = flag.String("zk.auth", "", "ZooKeeper authentication as scheme:credential, e.g. digest:user:pass.")
+	zkReadHosts        = flag.String("zk.read-hosts", "", "Comma-separated ZooKeeper servers to connect to instead of those in the URL.")
+	zkSessionTimeout   = flag.Duration("zk.session-timeout", 20*time.Second, "ZooKeeper session timeout.")
+	zkResolveInterval  = flag.Duration("zk.resolve-interval", 0, "Minimum interval between resolving the ZooKeeper server names again after failing to connect to all their addresses, 0 to never.")
+	zkWatchInterval    = flag.Duration("zk.watch-interval", 1*time.Second, "Interval between ZooKeeper leader lookups.")
+	zkWatchMaxInterval = flag.Duration("zk.watch-max-interval", 30*time.Second,
+		"Upper bound the ZooKeeper lookup interval backs off to after consecutive errors.")
+	zkWatchJitter  = flag.Float64("zk.watch-jitter", 0.1, "Fraction by which ZooKeeper lookup intervals are randomly spread.")
+	zkTLSCAFile    = flag.String("zk.tls.ca-file", "", "CA certificate file used to verify ZooKeeper servers, enables TLS.")
+	zkTLSCertFile  = flag.String("zk.tls.cert-file", "", "Client certificate file presented to ZooKeeper, enables TLS.")
+	zkTLSKeyFile   = flag.String("zk.tls.key-file", "", "Client key file presented to ZooKeeper, enables TLS.")
+	zkLogEvents    = flag.Bool("zk.log-events", true, "Log ZooKeeper connection events at debug level.")
+	leaderCacheTTL = flag.Duration("leader.cache-ttl", 30*time.Second,
+		"How long a resolved leader is reused before it is looked up again, 0 disables caching.")
+	leaderEndpoint = flag.String("leader.prefer-endpoint", "http",
+		"Name of the additional leader endpoint to scrape, falling back to the service endpoint.")
+	httpRetries      = flag.Int("http.retries", 2, "Number of times a failed HTTP leader lookup is retried.")
+	httpTimeout      = flag.Duration("http.timeout", 10*time.Second, "Timeout of a single HTTP leader lookup attempt.")
+	httpMaxIdleConns = flag.Int("http.max-idle-conns", 10, "Maximum number of idle connections to schedulers, 0 means no limit.")
+	httpIdleTimeout  = flag.Duration("http.idle-conn-timeout", 90*time.Second,
+		"How long an idle connection to a scheduler is kept open, 0 means no limit.")
+	httpRateLimit    = flag.Float64("http.rate-limit", 0, "Requests per second sent to schedulers at most, 0 means no limit.")
+	httpRateBurst    = flag.Int("http.rate-burst", 5, "Number of requests sent to schedulers at once despite the rate limit.")
+	httpRateFailFast = flag.Bool("http.rate-fail-fast", false, "Fail requests over the rate limit instead of delaying them.")
+	httpUserAgent    = flag.String("http.user-agent", "", "User-Agent of scheduler requests, aurora_exporter/<version> if empty.")
+	httpUsername     = flag.String("http.username", "", "Username for HTTP basic auth against the scheduler.")
+	httpPassword     = flag.String("http.password", "", "Password for HTTP basic auth against the scheduler.")
+	httpPasswordFile = flag.String("http.password-file", "", "File containing the password for HTTP basic auth.")
+	httpBearerFile   = flag.String("http.bearer-token-file", "", "File containing the bearer token sent to schedulers, read for every request.")
+	tlsCAFile        = flag.String("tls.ca-file", "", "CA certificate file used to verify the scheduler.")
+	tlsCertFile      = flag.String("tls.cert-file", "", "Client certificate file presented to the scheduler.")
+	tlsKeyFile       = flag.String("tls.key-file", "", "Client key file presented to the scheduler.")
+	tlsInsecure      = flag.Bool("tls.insecure-skip-verify", false, "Don't verify the scheduler certificate.")
+	resolveOnly      = flag.Bool("resolve-only", false, "Print the resolved leader URL and exit.")
+	resolveTimeout   = flag.Duration("resolve-timeout", 30*time.Second, "How long -resolve-only and -dry-run wait for a leader.")
+	dryRun           = flag.Bool("dry-run", false, "Scrape the leader once, print the metrics and exit.")
+	waitLeader       = flag.Duration("wait-for-leader", 0, "How long to wait for a leader before serving, 0 doesn't wait.")
+	logFormat        = flag.String("log.format", "glog", "Format of finder log messages, glog or json.")
+	metricInclude    = flag.String("metric.include", "", "Regexp the names of exported scheduler metrics must match, all if empty.")
+	metricExclude    = flag.String("metric.exclude", "", "Regexp of scheduler metric names not to export, even if included.")
+	compatUntyped    = flag.Bool("compat.untyped", false, "Export all scheduler metrics as untyped, for scrapers that fail on their types.")
+	showVersion      = flag.Bool("version", false, "Print the version and exit.")
+	envStrict        = flag.Bool("env.strict", false, "Fail on unset environment variables referenced in finder flags.")
+	logLevelName     = flag.String("log.level", "info", "Minimum level of finder log messages, debug, info, warn or error.")
 )
 
-var noLables = []string{}
+// constLabels are attached to all metrics of the exporter.
+var constLabels = labelFlag{}
+
+// clusters are the schedulers to scrape instead of -exporter.aurora-url.
+var clusters = &clusterFlag{urls: make(map[string]string)}
 
-var httpClient = http.Client{
-	Transport: &http.Transport{
-		MaxIdleConnsPerHost:   2,
-		ResponseHeaderTimeout: 10 * time.Second,
-		Dial: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 10 * time.Second,
-		}).Dial,
-	},
+func init() {
+	flag.Var(constLabels, "label", "Label as key=value attached to all exported metrics, may be repeated.")
+	flag.Var(clusters, "exporter.cluster",
+		"Cluster as name=url to scrape instead of the aurora-url, its metrics labeled cluster=name, may be repeated.")
 }
 
+var noLables = []string{}
+
+var landingPage = template.Must(template.New("landing").Parse(`<html>
+<head><title>Aurora Exporter</title></head>
+<body>
+<h1>Aurora Exporter</h1>
+<p><a href="{{.}}">Metrics</a></p>
+</body>
+</html>
+`))
+
 type exporter struct {
 	sync.Mutex
+	fLock        sync.RWMutex
 	f            finder
+	url          string // of the schedulers f finds the leader of
 	errors       prometheus.Counter
 	duration     prometheus.Gauge
+	samples      prometheus.Gauge
+	up           prometheus.Gauge
+	lastError    prometheus.Gauge
+	scrapeTime   prometheus.Summary
+	parseErrors  prometheus.Counter
+	malformed    prometheus.Gauge
+	droppedVars  prometheus.Counter
+	collisions   map[string]bool // vars whose dropping was logged
+	finderKind   string
+	leaderHost   string
+	leaderPath   string
 	pendingTasks *prometheus.GaugeVec
+	leaderUp     *prometheus.GaugeVec
+	leaderInfo   *prometheus.GaugeVec
+	parsers      parsers
+	timeout      int64 // of the next scrape in nanoseconds, accessed atomically
+
+	// After breakerFailures consecutive failed scrapes, scrapes fail right
+	// away until openUntil, breakerCooldown later. 0 failures disables this.
+	breakerFailures int
+	breakerCooldown time.Duration
+	failures        int
+	openUntil       time.Time
+
+	// While scrapes fail, the metrics of the last successful one, from
+	// lastGoodAt, are served for serveStale.
+	serveStale time.Duration
+	lastGood   []prometheus.Metric
+	lastGoodAt time.Time
+	failed     bool // whether the last scrape failed
+
+	labels           prometheus.Labels
+	include, exclude *regexp.Regexp
+	untyped          bool
+	bypass           bool
+	retries          int
+	varsPath         string
+	noLeaderOK       bool
+	unknownVars      bool
 }
 
 type pendingTask struct {
@@ -52,9 +188,50 @@ type pendingTask struct {
 	Name      string
 }
 
-func newAuroraExporter(f finder) *exporter {
-	return &exporter{
-		f: f,
+// CollectorOpts are the settings of a collector returned by NewCollector.
+type CollectorOpts struct {
+	// URL is scraped directly with -exporter.bypass-leader-redirect.
+	URL string
+	// Timeout of the scheduler requests of a scrape.
+	Timeout time.Duration
+	// BreakerFailures and BreakerCooldown configure the scrape breaker,
+	// see the exporter fields.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	// ServeStale is how long the scheduler metrics of the last successful
+	// scrape are served when scrapes fail, 0 disables this.
+	ServeStale time.Duration
+	// Labels are attached to all metrics registered by Register.
+	Labels prometheus.Labels
+	// Include and Exclude, if not nil, restrict the scheduler metrics to
+	// those whose name Include matches, unless Exclude does.
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+	// Untyped exports the scheduler metrics as untyped, whatever their type.
+	Untyped bool
+	// BypassRedirect scrapes URL rather than the leader, see
+	// -exporter.bypass-leader-redirect.
+	BypassRedirect bool
+	// Retries is the number of times a scheduler request answered with 502,
+	// 503 or 504 is retried, none by default.
+	Retries int
+	// VarsPath is the path of the scheduler stats. Defaults to /vars.
+	VarsPath string
+	// NoLeaderOK counts scrapes without a leader as successful.
+	NoLeaderOK bool
+	// UnknownVars exports the vars without a known metric.
+	UnknownVars bool
+}
+
+// NewCollector returns an exporter scraping the scheduler leader f finds.
+// It isn't registered anywhere, use Register for that.
+func NewCollector(f finder, opts CollectorOpts) *exporter {
+	e := &exporter{
+		f:          f,
+		url:        opts.URL,
+		labels:     opts.Labels,
+		collisions: make(map[string]bool),
+		parsers:    newParsers(),
 		errors: prometheus.NewGauge(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
@@ -67,6 +244,48 @@ func newAuroraExporter(f finder) *exporter {
 				Name:      "exporter_last_scrape_duration_seconds",
 				Help:      "The last scrape duration",
 			}),
+		samples: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "exporter_last_scrape_samples",
+				Help:      "Number of samples the last scrape of the scheduler produced",
+			}),
+		up: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "up",
+				Help:      "Whether the last scrape of the scheduler succeeded",
+			}),
+		lastError: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "last_scrape_error",
+				Help:      "Whether the last scrape of the scheduler failed",
+			}),
+		scrapeTime: prometheus.NewSummary(
+			prometheus.SummaryOpts{
+				Namespace: namespace,
+				Name:      "scrape_duration_seconds",
+				Help:      "Duration of scheduler scrapes",
+			}),
+		parseErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "scrape_parse_errors_total",
+				Help:      "Number of malformed scheduler vars lines skipped",
+			}),
+		malformed: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "scrape_malformed_lines",
+				Help:      "Number of malformed vars lines the last scrape of the scheduler skipped",
+			}),
+		droppedVars: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "scrape_dropped_vars_total",
+				Help:      "Number of vars without a known metric dropped because another var took their metric name",
+			}),
 		pendingTasks: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
@@ -75,12 +294,116 @@ func newAuroraExporter(f finder) *exporter {
 			},
 			[]string{"role", "env", "job"},
 		),
+		leaderUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "leader_up",
+				Help:      "Whether the scheduler leader could be resolved",
+			},
+			[]string{"finder"},
+		),
+		leaderInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "leader_info",
+				Help:      "The scheduler instance currently scraped",
+			},
+			[]string{"host", "path"},
+		),
+	}
+	e.applyOptions(opts)
+
+	return e
+}
+
+// setOptions makes the scrapes after the one in progress, if any, use the
+// settings of opts other than URL and Labels, see NewCollector.
+func (e *exporter) setOptions(opts CollectorOpts) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.applyOptions(opts)
+}
+
+func (e *exporter) applyOptions(opts CollectorOpts) {
+	if opts.VarsPath == "" {
+		opts.VarsPath = "/vars"
+	}
+
+	atomic.StoreInt64(&e.timeout, int64(opts.Timeout))
+	e.breakerFailures, e.breakerCooldown = opts.BreakerFailures, opts.BreakerCooldown
+	e.serveStale = opts.ServeStale
+	e.include, e.exclude, e.untyped = opts.Include, opts.Exclude, opts.Untyped
+	e.bypass, e.retries, e.varsPath = opts.BypassRedirect, opts.Retries, opts.VarsPath
+	e.noLeaderOK, e.unknownVars = opts.NoLeaderOK, opts.UnknownVars
+}
+
+// Register registers e along with the build info and the scheduler request
+// durations on r, so the exporter can share a registry other than the
+// default one.
+func (e *exporter) Register(r prometheus.Registerer) error {
+	return register(r, e.labels, e)
+}
+
+// register registers c along with the build info and the scheduler request
+// durations on r, all with labels attached.
+func register(r prometheus.Registerer, labels prometheus.Labels, c prometheus.Collector) error {
+	for _, c := range []prometheus.Collector{c, buildInfo, schedulerRequests} {
+		if err := r.Register(withLabels(c, labels)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setFinder makes e use f, for the schedulers at url, for subsequent scrapes
+// and closes the finder used so far once an in-flight scrape is done with it.
+func (e *exporter) setFinder(f finder, url string) {
+	e.Lock()
+	e.fLock.Lock()
+	old := e.f
+	e.f, e.url = f, url
+	e.fLock.Unlock()
+	e.Unlock()
+
+	if old != nil {
+		old.Close()
 	}
 }
 
+// finder returns the finder currently in use.
+func (e *exporter) finder() finder {
+	e.fLock.RLock()
+	defer e.fLock.RUnlock()
+
+	return e.f
+}
+
+var targetInfoDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "exporter", "target_info"),
+	"Type of finder and zNodes the scheduler leader is found with, always 1",
+	[]string{"type", "znode"}, nil,
+)
+
 func (e *exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- targetInfoDesc
 	ch <- e.duration.Desc()
+	ch <- e.samples.Desc()
 	ch <- e.errors.Desc()
+	ch <- e.up.Desc()
+	ch <- e.lastError.Desc()
+	ch <- e.scrapeTime.Desc()
+	ch <- e.parseErrors.Desc()
+	ch <- e.malformed.Desc()
+	ch <- e.droppedVars.Desc()
+	e.pendingTasks.Describe(ch)
+	e.leaderUp.Describe(ch)
+	e.leaderInfo.Describe(ch)
+	// Finders replaced on reload have metrics of their own, but all of
+	// them describe the same.
+	newFinderMetrics().Describe(ch)
+	e.parsers.describeVars(ch)
 }
 
 func (e *exporter) Collect(ch chan<- prometheus.Metric) {
@@ -90,21 +413,73 @@ func (e *exporter) Collect(ch chan<- prometheus.Metric) {
 	metricsChan := make(chan prometheus.Metric)
 	go e.scrape(metricsChan)
 
+	var metrics []prometheus.Metric
 	for metric := range metricsChan {
+		if e.keep(metric) {
+			if e.untyped {
+				metric = untypedMetric{metric}
+			}
+			metrics = append(metrics, metric)
+		}
+	}
+
+	if e.serveStale > 0 {
+		switch {
+		case !e.failed:
+			e.lastGood, e.lastGoodAt = make([]prometheus.Metric, 0, len(metrics)), time.Now()
+			for _, metric := range metrics {
+				if frozen, err := freeze(metric); err == nil {
+					e.lastGood = append(e.lastGood, frozen)
+				}
+			}
+		case time.Since(e.lastGoodAt) <= e.serveStale:
+			metrics = e.lastGood
+		default:
+			// Past serveStale a failed scrape serves none of the
+			// scheduler metrics, not the part scraped before it failed.
+			metrics = nil
+		}
+	}
+
+	for _, metric := range metrics {
 		ch <- metric
 	}
+	e.samples.Set(float64(len(metrics)))
 
 	ch <- e.errors
 	ch <- e.duration
+	ch <- e.samples
+	ch <- e.up
+	ch <- e.lastError
+	ch <- prometheus.MustNewConstMetric(targetInfoDesc, prometheus.GaugeValue, 1,
+		finderType(e.finder()), finderZNodes(e.finder()))
+	ch <- e.scrapeTime
+	ch <- e.parseErrors
+	ch <- e.malformed
+	ch <- e.droppedVars
+	e.leaderUp.Collect(ch)
+	e.leaderInfo.Collect(ch)
+	if m := metricsOf(e.finder()); m != nil {
+		m.Collect(ch)
+	}
 }
 
-func (e *exporter) parsePending(url string, bypass bool, ch chan<- prometheus.Metric) error {
-	req, err := newRequest("GET", url+"/pendingtasks", nil, bypass)
-	if err != nil {
-		return err
+// keep reports whether the name of m passes the include and exclude filters.
+func (e *exporter) keep(m prometheus.Metric) bool {
+	if e.include == nil && e.exclude == nil {
+		return true
 	}
 
-	resp, err := httpClient.Do(req)
+	name := metricFQName(m.Desc())
+	if e.exclude != nil && e.exclude.MatchString(name) {
+		return false
+	}
+
+	return e.include == nil || e.include.MatchString(name)
+}
+
+func (e *exporter) parsePending(ctx context.Context, url string, bypass bool, ch chan<- prometheus.Metric) error {
+	resp, err := currentClient().get(ctx, url+"/pendingtasks", bypass, e.retries)
 	if err != nil {
 		return err
 	}
@@ -115,41 +490,45 @@ func (e *exporter) parsePending(url string, bypass bool, ch chan<- prometheus.Me
 		return err
 	}
 
+	jobs := make(map[string]bool)
 	for _, task := range pending {
 		jobKey := strings.Split(task.Name, "/")
 		count := len(task.TaskIds)
 		metric := e.pendingTasks.WithLabelValues(jobKey[0], jobKey[1], jobKey[2])
 		metric.Set(float64(count))
 		ch <- metric
+		jobs[task.Name] = true
 	}
+	ch <- prometheus.MustNewConstMetric(jobsPendingDesc, prometheus.GaugeValue, float64(len(jobs)))
 
 	return nil
 }
 
-func (e *exporter) parseVars(url string, bypass bool, ch chan<- prometheus.Metric) error {
-	req, err := newRequest("GET", url+"/vars.json", nil, bypass)
+func (e *exporter) parseVars(ctx context.Context, url string, bypass bool, ch chan<- prometheus.Metric) error {
+	resp, err := currentClient().get(ctx, url+e.varsPath, bypass, e.retries)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	resp, err := httpClient.Do(req)
+	vars, malformed, err := decodeVars(resp)
+	e.malformed.Set(float64(malformed))
+	e.parseErrors.Add(float64(malformed))
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	var vars map[string]interface{}
-	if err = json.NewDecoder(resp.Body).Decode(&vars); err != nil {
-		return err
-	}
+	ch <- prometheus.MustNewConstMetric(jobsDesc, prometheus.GaugeValue, float64(countJobs(vars)))
 
+	var unknown []string
 	for name, v := range vars {
 		v, ok := v.(float64)
 		if !ok {
 			continue
 		}
 
-		if desc, ok := counters[name]; ok {
+		desc, counter := counters[name]
+		if counter {
 			ch <- prometheus.MustNewConstMetric(
 				desc,
 				prometheus.CounterValue,
@@ -157,7 +536,8 @@ func (e *exporter) parseVars(url string, bypass bool, ch chan<- prometheus.Metri
 			)
 		}
 
-		if desc, ok := gauges[name]; ok {
+		desc, gauge := gauges[name]
+		if gauge {
 			ch <- prometheus.MustNewConstMetric(
 				desc,
 				prometheus.GaugeValue,
@@ -165,7 +545,36 @@ func (e *exporter) parseVars(url string, bypass bool, ch chan<- prometheus.Metri
 			)
 		}
 
-		labelVars(ch, name, v)
+		if !e.parsers.labelVars(ch, name, v) && !counter && !gauge {
+			unknown = append(unknown, name)
+		}
+	}
+	if !e.unknownVars {
+		return nil
+	}
+
+	// Percentiles are grouped into one metric, only of vars no known metric
+	// took, so per-job vars like tasks_RUNNING_role/env/job_p50 stay theirs.
+	seen, unknown := percentileVars(ch, vars, unknown)
+
+	// Several vars may map to one metric name, the first in sort order is
+	// exported so the choice is the same on every scrape.
+	for _, name := range unknown {
+		metric := metricName(name)
+		if metric == "" {
+			continue
+		}
+		if seen[metric] {
+			e.droppedVars.Inc()
+			if !e.collisions[name] {
+				glog.Warningf("dropping var %q, its metric name %q is taken", name, metric)
+				e.collisions[name] = true
+			}
+			continue
+		}
+		seen[metric] = true
+
+		ch <- prometheus.MustNewConstMetric(unknownVarDesc(name), classifyVar(name), vars[name].(float64), noLables...)
 	}
 
 	return nil
@@ -174,66 +583,535 @@ func (e *exporter) parseVars(url string, bypass bool, ch chan<- prometheus.Metri
 func (e *exporter) scrape(ch chan<- prometheus.Metric) {
 	defer close(ch)
 
+	var failed bool
+
 	now := time.Now().UnixNano()
 	defer func() {
-		e.duration.Set(float64(time.Now().UnixNano()-now) / 1000000000)
+		d := float64(time.Now().UnixNano()-now) / 1000000000
+		e.duration.Set(d)
+		e.scrapeTime.Observe(d)
+
+		e.failed = failed
+		if failed {
+			e.up.Set(0)
+			e.lastError.Set(1)
+		} else {
+			e.up.Set(1)
+			e.lastError.Set(0)
+		}
 	}()
 
 	recordErr := func(err error) {
 		glog.Warning(err)
 		e.errors.Inc()
+		failed = true
 	}
 
+	if time.Now().Before(e.openUntil) {
+		recordErr(fmt.Errorf("not scraping the scheduler until %s after %d failed scrapes",
+			e.openUntil.Format(time.RFC3339), e.failures))
+		return
+	}
+	defer e.countFailure(&failed)
+
+	// Finding the leader and both requests share the deadline, so neither a
+	// slow lookup nor a hung scheduler can stall the scrape past the timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(atomic.LoadInt64(&e.timeout)))
+	defer cancel()
+
 	var url string
 	var err error
-	if *bypassRedirect {
-		url = *auroraURL
+	if e.bypass {
+		url = e.url
 	} else {
-		url, err = e.f.leaderURL()
+		waitForFirstLookup(ctx, e.finder())
+		url, err = e.finder().leaderURL(ctx)
 	}
+
+	// A compositeFinder changes type when falling back, the series of the
+	// type used before is dropped.
+	kind := finderType(e.finder())
+	if kind != e.finderKind {
+		e.leaderUp.DeleteLabelValues(e.finderKind)
+		e.finderKind = kind
+	}
+	found := e.leaderUp.WithLabelValues(kind)
 	if err != nil {
+		found.Set(0)
+		e.setLeaderHost("")
+		// Without a leader, as in a fresh cluster, there is nothing to
+		// scrape, which may be fine.
+		if e.noLeaderOK && errorCause(err) == ErrNoLeader {
+			glog.V(2).Info("no leader to scrape: ", err)
+			return
+		}
 		recordErr(err)
 		return
 	}
+	found.Set(1)
+	e.setLeaderHost(url)
 
-	if err = e.parsePending(url, *bypassRedirect, ch); err != nil {
+	if err = e.parsePending(ctx, url, e.bypass, ch); err != nil {
 		recordErr(err)
 	}
 
-	if err = e.parseVars(url, *bypassRedirect, ch); err != nil {
+	if err = e.parseVars(ctx, url, e.bypass, ch); err != nil {
 		recordErr(err)
 	}
+
+	// The scheduler we talked to might no longer be the leader.
+	if c, ok := e.finder().(*cachingFinder); ok && failed {
+		c.invalidate()
+	}
+}
+
+// countFailure keeps track of consecutive failed scrapes and stops scraping
+// for the cooldown once there are too many. A scrape after the cooldown that
+// fails again stops scraping right away.
+func (e *exporter) countFailure(failed *bool) {
+	if !*failed {
+		e.failures = 0
+		return
+	}
+
+	e.failures++
+	if e.breakerFailures > 0 && e.failures >= e.breakerFailures {
+		e.openUntil = time.Now().Add(e.breakerCooldown)
+		glog.Warningf("%d failed scrapes, not scraping the scheduler for %s", e.failures, e.breakerCooldown)
+	}
+}
+
+// setLeaderHost points aurora_leader_info at the host of leader, dropping
+// the series of the previous leader.
+func (e *exporter) setLeaderHost(leader string) {
+	var host, path string
+	if u, err := neturl.Parse(leader); err == nil {
+		host = u.Host
+	}
+	if host != "" {
+		path = finderPath(e.finder())
+	}
+
+	if host != e.leaderHost || path != e.leaderPath {
+		e.leaderInfo.DeleteLabelValues(e.leaderHost, e.leaderPath)
+		e.leaderHost, e.leaderPath = host, path
+	}
+
+	if host != "" {
+		e.leaderInfo.WithLabelValues(host, path).Set(1)
+	}
+}
+
+// metricsHandler serves h, limiting the -scrape.timeout of es to the one
+// Prometheus announces in the X-Prometheus-Scrape-Timeout-Seconds header,
+// less the -scrape.timeout-offset. Requests are served one at a time, as the
+// exporters only run one scrape at a time anyway.
+type metricsHandler struct {
+	sync.Mutex
+	es []*exporter
+	h  http.Handler
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+
+	settings := currentSettings()
+	timeout := settings.collector.Timeout
+	if s, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64); err == nil {
+		t := time.Duration(s*float64(time.Second)) - settings.timeoutOffset
+		if t > 0 && t < timeout {
+			timeout = t
+		}
+	}
+	for _, e := range h.es {
+		atomic.StoreInt64(&e.timeout, int64(timeout))
+	}
+
+	h.h.ServeHTTP(w, r)
+}
+
+// drainHandler serves h and counts the requests in flight, so they can be
+// waited for on shutdown.
+type drainHandler struct {
+	h        http.Handler
+	inFlight int64 // accessed atomically
+}
+
+func (d *drainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&d.inFlight, 1)
+	defer atomic.AddInt64(&d.inFlight, -1)
+
+	d.h.ServeHTTP(w, r)
+}
+
+// wait waits up to timeout for the requests in flight to finish and reports
+// whether they did.
+func (d *drainHandler) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&d.inFlight) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return true
+}
+
+// readyHandler reports ready once each of the finders resolved a leader for
+// the first time.
+type readyHandler struct {
+	fs    []func() finder
+	ready int32
 }
 
-func newRequest(method, urlStr string, body io.Reader, bypass bool) (*http.Request, error) {
-	req, err := http.NewRequest(method, urlStr, body)
+func newReadyHandler(fs ...func() finder) *readyHandler {
+	return &readyHandler{fs: fs}
+}
+
+func (h *readyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.ready) == 0 {
+		for _, f := range h.fs {
+			if _, err := f().leaderURL(r.Context()); err != nil {
+				http.Error(w, "no leader found: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		atomic.StoreInt32(&h.ready, 1)
+	}
+
+	io.WriteString(w, "OK\n")
+}
+
+// printMetrics waits for fs to find a leader, runs a single collection of g
+// and writes the gathered metrics to w in the text exposition format.
+func printMetrics(w io.Writer, g prometheus.Gatherer, fs []finder, timeout time.Duration) error {
+	for _, f := range fs {
+		if _, err := resolveLeader(f, timeout); err != nil {
+			return err
+		}
+	}
+
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// printLeaders waits for fs to find a leader and writes their URLs to w, one
+// per line and preceded by the cluster name if there is one.
+func printLeaders(w io.Writer, names []string, fs []finder, timeout time.Duration) error {
+	for i, f := range fs {
+		leader, err := resolveLeader(f, timeout)
+		if err != nil {
+			return err
+		}
+
+		if names[i] != "" {
+			fmt.Fprint(w, names[i], " ")
+		}
+		fmt.Fprintln(w, leader)
+	}
+
+	return nil
+}
+
+// listen listens on the TCP address addr or, for unix:/path/to.sock, on
+// a unix socket, replacing a stale socket file left by an earlier run.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// finderFlags are the flags the finders depend on, see settings.newFinder.
+var finderFlags = []string{
+	"exporter.aurora-url", "finder.type", "finder.fallback-url", "finder.fallback-after", "zk.znode",
+	"zk.leader-prefix", "zk.auth", "zk.read-hosts", "zk.accepted-statuses", "zk.entity-format",
+	"zk.session-timeout", "zk.watch-interval", "zk.watch-max-interval", "zk.watch-jitter", "zk.log-events",
+	"zk.resolve-interval", "zk.tls.ca-file", "zk.tls.cert-file", "zk.tls.key-file", "leader.cache-ttl",
+	"leader.prefer-endpoint", "http.retries", "http.timeout",
+}
+
+// clusterSuffix names the cluster in log messages, if there is one.
+func clusterSuffix(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	return " of cluster " + name
+}
+
+// fallback returns the -finder.fallback-url, which only applies to the
+// aurora-url, not to clusters.
+func fallback() string {
+	if len(clusters.names) > 0 {
+		return ""
+	}
+
+	return *fallbackURL
+}
+
+// finderSettings returns the current values of the finder flags.
+func finderSettings() string {
+	var values []string
+	for _, name := range finderFlags {
+		values = append(values, flag.Lookup(name).Value.String())
+	}
+
+	return strings.Join(values, "\x00")
+}
+
+// reload re-reads the config file and makes its settings the current ones.
+// The exporters es scrape with the new settings from their next scrape on,
+// and c collects them with the new concurrency. If the finder settings
+// changed, the finders of es are swapped for new ones.
+func reload(es []*exporter, c *clusterCollector, explicit map[string]bool) error {
+	if *configFile == "" {
+		return errors.New("no config file given")
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if err := applyConfig(cfg, explicit); err != nil {
+		return err
+	}
+	s, err := loadSettings()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if bypass {
-		req.Header.Add("Bypass-Leader-Redirect", "true")
+
+	if s.finderKey == currentSettings().finderKey {
+		glog.Info("reloaded config, finder settings unchanged")
+	} else {
+		_, urls := clusters.targets(*auroraURL)
+		fs, err := s.newFinders(urls)
+		if err != nil {
+			return err
+		}
+		for i, e := range es {
+			e.setFinder(fs[i], urls[i])
+		}
+		glog.Info("reloaded config, now using finders for ", redactURL(strings.Join(urls, ",")))
 	}
 
-	return req, nil
+	setSettings(s)
+	for _, e := range es {
+		e.setOptions(s.collector)
+	}
+	c.setConcurrency(s.concurrency)
+
+	return nil
 }
 
 func main() {
 	flag.Parse()
 
-	finder, err := newFinder(*auroraURL)
+	if *showVersion {
+		fmt.Println(versionInfo())
+		os.Exit(0)
+	}
+
+	if err := checkClusterLabel(constLabels, clusters); err != nil {
+		log.Fatal(err)
+	}
+
+	explicit := explicitFlags()
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err == nil {
+			err = applyConfig(c, explicit)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	level, err := parseLogLevel(*logLevelName)
 	if err != nil {
 		log.Fatal(err)
 	}
+	switch *logFormat {
+	case "glog":
+		finderLog = glogLogger{debug: level == levelDebug}
+	case "json":
+		finderLog = newJSONLogger(os.Stderr)
+	default:
+		log.Fatalf("unknown log format %q", *logFormat)
+	}
+	finderLog = levelLogger{logger: finderLog, level: level}
+
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatal(err)
+	}
+	setSettings(settings)
+
+	names, urls := clusters.targets(*auroraURL)
+	finders, err := settings.newFinders(urls)
+	if err != nil {
+		log.Fatal(err)
+	}
+	closeFinders := func() {
+		for _, f := range finders {
+			f.Close()
+		}
+	}
+	for i, f := range finders {
+		glog.Infof("finding the leader%s with a %s finder at %s, zNodes %q", clusterSuffix(names[i]),
+			finderType(f), redactURL(urls[i]), finderZNodes(f))
+	}
 
-	exporter := newAuroraExporter(finder)
-	prometheus.MustRegister(exporter)
+	if *resolveOnly {
+		err := printLeaders(os.Stdout, names, finders, *resolveTimeout)
+		closeFinders()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Each cluster gets its own exporter, labeled by the cluster name unless
+	// only the aurora-url is scraped.
+	var exporters []*exporter
+	collectors := &clusterCollector{}
+	collectors.setConcurrency(settings.concurrency)
+	for i, f := range finders {
+		opts := settings.collector
+		opts.URL = urls[i]
+		if names[i] != "" {
+			opts.Labels = prometheus.Labels{clusterLabel: names[i]}
+		}
 
-	http.Handle(*metricPath, prometheus.Handler())
+		e := NewCollector(f, opts)
+		exporters = append(exporters, e)
+		collectors.collectors = append(collectors.collectors, withLabels(e, opts.Labels))
+	}
+	if err := register(prometheus.DefaultRegisterer, prometheus.Labels(constLabels), collectors); err != nil {
+		log.Fatal(err)
+	}
+
+	if *dryRun {
+		err := printMetrics(os.Stdout, prometheus.DefaultGatherer, finders, *resolveTimeout)
+		closeFinders()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var currentFinders []func() finder
+	for _, e := range exporters {
+		currentFinders = append(currentFinders, e.finder)
+	}
+
+	http.Handle(*metricPath, &metricsHandler{es: exporters, h: prometheus.Handler()})
+	probes := newProbeHandler()
+	http.Handle("/probe", probes)
+	http.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK\n")
+	})
+	http.Handle("/-/ready", newReadyHandler(currentFinders...))
+	http.HandleFunc("/debug/leader", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if names[0] == "" {
+			json.NewEncoder(w).Encode(debugLeader(r.Context(), exporters[0].finder()))
+			return
+		}
+
+		leaders := make(map[string]leaderDebug)
+		for i, e := range exporters {
+			leaders[names[i]] = debugLeader(r.Context(), e.finder())
+		}
+		json.NewEncoder(w).Encode(leaders)
+	})
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, *metricPath, http.StatusMovedPermanently)
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		landingPage.Execute(w, *metricPath)
 	})
 
+	listener, err := listen(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// On SIGINT or SIGTERM no new connections are accepted, but requests in
+	// flight get up to -web.shutdown-timeout to finish, so Prometheus doesn't
+	// record a scrape cut short.
+	drain := &drainHandler{h: http.DefaultServeMux}
+	server := &http.Server{Handler: drain}
+	stopping, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+
+		glog.Info("stopping aurora_exporter")
+		close(stopping)
+		server.SetKeepAlivesEnabled(false)
+		// Closing removes the socket file of a unix listener.
+		listener.Close()
+		if !drain.wait(*shutdownWait) {
+			glog.Warning("stopping with requests still in flight")
+		}
+		for _, e := range exporters {
+			e.finder().Close()
+		}
+		probes.Close()
+		glog.Flush()
+		close(stopped)
+	}()
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := reload(exporters, collectors, explicit); err != nil {
+				glog.Warning("reload failed: ", err)
+			}
+		}
+	}()
+
+	if *waitLeader > 0 {
+		for _, e := range exporters {
+			if _, err := resolveLeader(e.finder(), *waitLeader); err != nil {
+				glog.Warning("serving without a leader: ", err)
+			}
+		}
+	}
+
 	glog.Info("starting aurora_exporter on ", *addr)
 
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	err = server.Serve(listener)
+	select {
+	case <-stopping:
+		<-stopped
+	default:
+		log.Fatal(err)
+	}
 }
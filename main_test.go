@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestExporterCollectsItsFinderMetrics(t *testing.T) {
+	var collectors []prometheus.Collector
+	for _, cluster := range []string{"east", "west"} {
+		f := &httpFinder{url: "http://127.0.0.1:0/" + cluster, timeout: time.Second, metrics: newFinderMetrics()}
+		f.metrics.transitions.Inc()
+		if cluster == "west" {
+			f.metrics.transitions.Inc()
+		}
+
+		labels := prometheus.Labels{clusterLabel: cluster}
+		collectors = append(collectors, withLabels(NewCollector(f, CollectorOpts{Labels: labels}), labels))
+	}
+
+	r := prometheus.NewRegistry()
+	if err := r.Register(&clusterCollector{collectors: collectors}); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]float64)
+	for _, mf := range mfs {
+		if mf.GetName() != "aurora_leader_transitions_total" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			got[m.Label[0].GetValue()] = metricValue(m)
+		}
+	}
+	if got["east"] != 1 || got["west"] != 2 {
+		t.Errorf("transitions by cluster are %v, want east 1 and west 2", got)
+	}
+}
+
+func TestScrapeTimeoutBoundsLeaderLookup(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	f := &httpFinder{url: srv.URL, timeout: 10 * time.Second, metrics: newFinderMetrics()}
+	e := NewCollector(f, CollectorOpts{Timeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	got := collect(t, e)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("the scrape took %s, the leader lookup isn't bounded by its timeout", d)
+	}
+	if got[`aurora_leader_up{finder="http"}`] != 0 {
+		t.Error("a leader was found")
+	}
+}
+
+func TestScrapeWaitsForFirstZkLookup(t *testing.T) {
+	conn := newFakeZkConn()
+	conn.setData("/aurora/scheduler/singleton_candidate_0000000001", leaderEntity("127.0.0.1", 1, "ALIVE"))
+	conn.setChildren("/aurora/scheduler", "singleton_candidate_0000000001")
+
+	// The first lookup comes only after the scrape started, as with a new
+	// finder.
+	c := testZkConfig()
+	c.ZKWatchInterval = 100 * time.Millisecond
+	decoder, err := newEntityDecoder(c.ZKEntityFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := startZkFinder(conn, []string{"/aurora/scheduler"}, decoder, c)
+	defer f.Close()
+
+	e := NewCollector(f, CollectorOpts{Timeout: 5 * time.Second})
+	if got := collect(t, e); got[`aurora_leader_up{finder="zk"}`] != 1 {
+		t.Error("the scrape didn't wait for the first lookup")
+	}
+}
+
+func TestScrapeDoesntWaitAfterFirstZkLookup(t *testing.T) {
+	conn := newFakeZkConn()
+	conn.setChildren("/aurora/scheduler")
+
+	f := newTestZkFinder(t, conn, "/aurora/scheduler")
+	defer f.Close()
+	<-f.looked
+
+	e := NewCollector(f, CollectorOpts{Timeout: 5 * time.Second, NoLeaderOK: true})
+	start := time.Now()
+	got := collect(t, e)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the scrape waited %s for a leader after the first lookup found none", d)
+	}
+	if got["aurora_up"] != 1 {
+		t.Errorf("aurora_up = %v without a leader and with no-leader-ok", got["aurora_up"])
+	}
+}
+
+func TestWaitForFirstLookupSkipsFallback(t *testing.T) {
+	f := newTestZkFinder(t, newFakeZkConn(), "/aurora/scheduler")
+	defer f.Close()
+	fb := &httpFinder{url: "http://127.0.0.1:1", timeout: time.Second, metrics: newFinderMetrics()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	waitForFirstLookup(ctx, newCompositeFinder(time.Minute, f, fb))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %s for a finder with a fallback", d)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	s := &stubFinder{err: errors.New("no leader")}
+	h := newReadyHandler(func() finder { return s })
+
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+		return rec.Code
+	}
+	if code := serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("got %d without a leader, want 503", code)
+	}
+	s.set("http://scheduler:8081", nil)
+	if code := serve(); code != http.StatusOK {
+		t.Errorf("got %d with a leader, want 200", code)
+	}
+
+	// Once ready, losing the leader doesn't make it unready.
+	s.set("", errors.New("no leader"))
+	if code := serve(); code != http.StatusOK {
+		t.Errorf("got %d after losing the leader, want 200", code)
+	}
+}
+
+func TestDebugLeader(t *testing.T) {
+	conn := newFakeZkConn()
+	conn.setChildren("/aurora/scheduler", "singleton_candidate_0000000001")
+	conn.setData("/aurora/scheduler/singleton_candidate_0000000001", leaderEntity("10.0.0.1", 8081, "ALIVE"))
+	f := newTestZkFinder(t, conn, "/aurora/scheduler")
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := f.waitForLeader(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	d := debugLeader(ctx, newCachingFinder(f, time.Minute))
+	if d.Finder != "zk" || d.Leader != "http://10.0.0.1:8081" || d.Status != "ALIVE" ||
+		d.ZNode != "/aurora/scheduler" || d.LastResolved == nil {
+		t.Errorf("got %+v", d)
+	}
+
+	d = debugLeader(ctx, &stubFinder{err: errors.New("down")})
+	if d.Error != "down" || d.LastResolved != nil {
+		t.Errorf("got %+v for a failing finder", d)
+	}
+}
+
+func TestPrintLeaders(t *testing.T) {
+	fs := []finder{&stubFinder{leader: "http://west:8081"}, &stubFinder{leader: "http://east:8081"}}
+
+	var b bytes.Buffer
+	if err := printLeaders(&b, []string{"west", "east"}, fs, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "print-leaders", b.String())
+
+	b.Reset()
+	if err := printLeaders(&b, []string{""}, fs[:1], time.Second); err != nil || b.String() != "http://west:8081\n" {
+		t.Errorf("printed %q, %v without cluster names", b.String(), err)
+	}
+}
+
+func TestResolveLeaderTimesOut(t *testing.T) {
+	conn := newFakeZkConn()
+	conn.setChildren("/aurora/scheduler")
+	f := newTestZkFinder(t, conn, "/aurora/scheduler")
+	defer f.Close()
+
+	start := time.Now()
+	if _, err := resolveLeader(f, 100*time.Millisecond); errorCause(err) != ErrNoLeader {
+		t.Errorf("got %v without a leader, want %v", err, ErrNoLeader)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("resolving took %s with a timeout of 100ms", d)
+	}
+
+	// A finder falling back to another finds the leader within the timeout.
+	fb := &stubFinder{leader: "http://fallback:8081"}
+	if leader, err := resolveLeader(newCompositeFinder(0, f, fb), time.Second); err != nil || leader != fb.leader {
+		t.Errorf("got %q, %v, want the leader of the fallback", leader, err)
+	}
+}
+
+func TestMetricsHandlerTimeoutFromHeader(t *testing.T) {
+	withConfigFile(t, "scrape:\n  timeout: 10s\n  timeout_offset: 500ms\n", func() {
+		if err := reload(nil, &clusterCollector{}, nil); err != nil {
+			t.Fatal(err)
+		}
+		e := NewCollector(nil, CollectorOpts{})
+		h := &metricsHandler{es: []*exporter{e}, h: http.NotFoundHandler()}
+
+		for header, want := range map[string]time.Duration{
+			"":     10 * time.Second,
+			"4":    3500 * time.Millisecond,
+			"30":   10 * time.Second,
+			"0.25": 10 * time.Second,
+		} {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if header != "" {
+				r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", header)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if got := time.Duration(atomic.LoadInt64(&e.timeout)); got != want {
+				t.Errorf("with a scrape timeout of %q the timeout is %s, want %s", header, got, want)
+			}
+		}
+	})
+}
+
+// checkGolden compares got to the contents of testdata/name.golden.
+func checkGolden(t *testing.T, name, got string) {
+	want, err := ioutil.ReadFile(filepath.Join("testdata", name+".golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from testdata/%s.golden, got:\n%s", name, got)
+	}
+}
+
+func TestPrintMetricsGolden(t *testing.T) {
+	vars, err := ioutil.ReadFile(filepath.Join("testdata", "vars.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pendingtasks":
+			w.Write([]byte(`[{"name": "www-data/prod/hello", "taskIds": ["a", "b"]}]`))
+		case "/vars":
+			w.Write(vars)
+		}
+	}))
+	defer srv.Close()
+
+	f := &httpFinder{url: srv.URL, timeout: time.Second, metrics: newFinderMetrics()}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(f, CollectorOpts{Timeout: time.Second}))
+
+	// The exporter's own metrics, like the scrape duration, vary between
+	// runs and are left out.
+	scheduler := regexp.MustCompile("^aurora_(jobs.*|tasks.*|task_store|jvm_.*|scheduler_lifecycle)$")
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := reg.Gather()
+		var kept []*dto.MetricFamily
+		for _, mf := range mfs {
+			if scheduler.MatchString(mf.GetName()) {
+				kept = append(kept, mf)
+			}
+		}
+		return kept, err
+	})
+
+	var b bytes.Buffer
+	if err := printMetrics(&b, g, []finder{f}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "print-metrics", b.String())
+}
+
+// testScheduler serves vars and no pending tasks until fail is set, then
+// answers 500. requests counts the requests served.
+type testScheduler struct {
+	*httptest.Server
+	fail, requests int32
+}
+
+// bypassOpts are collector options scraping s directly.
+func (s *testScheduler) bypassOpts() CollectorOpts {
+	return CollectorOpts{URL: s.URL, BypassRedirect: true, Timeout: time.Second}
+}
+
+func newTestScheduler() *testScheduler {
+	s := &testScheduler{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		if atomic.LoadInt32(&s.fail) != 0 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/pendingtasks":
+			w.Write([]byte("[]"))
+		default:
+			w.Write([]byte("jvm_uptime_secs 42\nscheduler_log_native_append_nanos_total 7\n"))
+		}
+	}))
+
+	return s
+}
+
+func TestScrapeBreaker(t *testing.T) {
+	s := newTestScheduler()
+	defer s.Close()
+	atomic.StoreInt32(&s.fail, 1)
+
+	opts := s.bypassOpts()
+	opts.BreakerFailures, opts.BreakerCooldown = 2, time.Hour
+	e := NewCollector(nil, opts)
+	collect(t, e)
+	errors := collect(t, e)["aurora_exporter_scrape_errors_total"]
+
+	atomic.StoreInt32(&s.fail, 0)
+	before := atomic.LoadInt32(&s.requests)
+	got := collect(t, e)
+	if n := atomic.LoadInt32(&s.requests); n != before {
+		t.Errorf("%d requests while the breaker is open", n-before)
+	}
+	if got["aurora_up"] != 0 || got["aurora_exporter_scrape_errors_total"] != errors+1 {
+		t.Errorf("got up %v and %v more errors, want the open breaker to fail the scrape", got["aurora_up"], got["aurora_exporter_scrape_errors_total"]-errors)
+	}
+
+	e.openUntil = time.Time{}
+	if got := collect(t, e); got["aurora_up"] != 1 {
+		t.Error("the scrape failed once the breaker closed")
+	}
+}
+
+func TestLastScrapeSamples(t *testing.T) {
+	vars, err := ioutil.ReadFile(filepath.Join("testdata", "vars.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pendingtasks":
+			w.Write([]byte(`[{"name": "www-data/prod/hello", "taskIds": ["a", "b"]}]`))
+		case "/vars":
+			w.Write(vars)
+		}
+	}))
+	defer srv.Close()
+
+	opts := CollectorOpts{URL: srv.URL, BypassRedirect: true, Timeout: time.Second}
+	ch := make(chan prometheus.Metric)
+	go NewCollector(nil, opts).scrape(ch)
+	var scraped int
+	for range ch {
+		scraped++
+	}
+
+	// The 20 vars of the fixture, the pending tasks of its one job and the
+	// number of jobs with and without pending tasks.
+	if scraped != 23 {
+		t.Errorf("the fixture produced %d samples, want 23", scraped)
+	}
+	if got := collect(t, NewCollector(nil, opts))["aurora_exporter_last_scrape_samples"]; got != float64(scraped) {
+		t.Errorf("aurora_exporter_last_scrape_samples = %v, want %d", got, scraped)
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "exporter.sock")
+	// The socket file of an earlier listener is in the way, as after a
+	// crash.
+	stale, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("the stale socket wasn't replaced: %s", err)
+	}
+	l.Close()
+	stale.Close()
+
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listen("unix:" + path); err == nil {
+		l.Close()
+		t.Error("a regular file was replaced")
+	}
+}
+
+func TestDrainHandlerWaitsForRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	d := &drainHandler{h: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	go d.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	<-started
+
+	if d.wait(60 * time.Millisecond) {
+		t.Error("wait returned with a request in flight")
+	}
+	close(release)
+	if !d.wait(time.Second) {
+		t.Error("wait timed out after the request finished")
+	}
+}
+
+func TestScrapeServesStale(t *testing.T) {
+	var failVars, failPending, pendingIds int32 = 0, 0, 2
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pendingtasks":
+			if atomic.LoadInt32(&failPending) != 0 {
+				http.Error(w, "down", http.StatusInternalServerError)
+				return
+			}
+			ids := strings.Repeat(`"id",`, int(atomic.LoadInt32(&pendingIds)))
+			fmt.Fprintf(w, `[{"name":"www/prod/hello","taskIds":[%s]}]`, strings.TrimSuffix(ids, ","))
+		default:
+			if atomic.LoadInt32(&failVars) != 0 {
+				http.Error(w, "down", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte("jvm_uptime_secs 42\n"))
+		}
+	}))
+	defer s.Close()
+
+	const pending = `aurora_tasks_pending{env="prod",job="hello",role="www"}`
+	e := NewCollector(nil, CollectorOpts{URL: s.URL, BypassRedirect: true, Timeout: time.Second, ServeStale: time.Hour})
+	collect(t, e)
+
+	// The pending tasks of the failed scrape change the gauge the last
+	// good scrape sent, what is served must not change with it.
+	atomic.StoreInt32(&failVars, 1)
+	atomic.StoreInt32(&pendingIds, 5)
+	got := collect(t, e)
+	if got["aurora_jvm_uptime_secs"] != 42 || got[pending] != 2 {
+		t.Errorf("the metrics of the last good scrape aren't served: %v", got)
+	}
+	if got["aurora_up"] != 0 {
+		t.Error("the failed scrape is reported up")
+	}
+
+	// Past -scrape.serve-stale, neither the last good metrics nor those a
+	// failed scrape got before failing are served.
+	atomic.StoreInt32(&failVars, 0)
+	atomic.StoreInt32(&failPending, 1)
+	e.lastGoodAt = time.Now().Add(-2 * time.Hour)
+	got = collect(t, e)
+	if _, ok := got["aurora_jvm_uptime_secs"]; ok {
+		t.Error("metrics of a failed scrape are served past -scrape.serve-stale")
+	}
+	if got["aurora_up"] != 0 || got["aurora_exporter_last_scrape_samples"] != 0 {
+		t.Errorf("got %v, want the failed scrape without samples", got)
+	}
+}
+
+func TestSchedulerRequestsObserved(t *testing.T) {
+	s := newTestScheduler()
+	defer s.Close()
+
+	count := func(code string) float64 {
+		return collect(t, schedulerRequests)[`aurora_scheduler_request_duration_seconds{code="`+code+`",type="scrape"}`]
+	}
+	ok, failed := count("200"), count("500")
+	e := NewCollector(nil, s.bypassOpts())
+	collect(t, e)
+	atomic.StoreInt32(&s.fail, 1)
+	collect(t, e)
+
+	if got := count("200") - ok; got != 2 {
+		t.Errorf("%v requests observed as 200, want 2", got)
+	}
+	if got := count("500") - failed; got < 1 {
+		t.Error("the failed request wasn't observed")
+	}
+}
+
+func TestScrapeWithoutLeader(t *testing.T) {
+	for _, noLeaderOK := range []bool{false, true} {
+		conn := newFakeZkConn()
+		conn.setChildren("/aurora/scheduler")
+		f := newTestZkFinder(t, conn, "/aurora/scheduler")
+
+		e := NewCollector(f, CollectorOpts{Timeout: 20 * time.Millisecond, NoLeaderOK: noLeaderOK})
+		got := collect(t, e)
+		f.Close()
+
+		if want := map[bool]float64{false: 0, true: 1}[noLeaderOK]; got["aurora_up"] != want {
+			t.Errorf("with -exporter.no-leader-ok=%t, up is %v, want %v", noLeaderOK, got["aurora_up"], want)
+		}
+		if got[`aurora_leader_up{finder="zk"}`] != 0 {
+			t.Error("a leader was found")
+		}
+	}
+}
+
+func TestExporterTargetInfo(t *testing.T) {
+	f := newTestZkFinder(t, newFakeZkConn(), "/aurora/scheduler", "/aurora/backup")
+	defer f.Close()
+
+	e := NewCollector(f, CollectorOpts{Timeout: 10 * time.Millisecond})
+	if got := collect(t, e); got[`aurora_exporter_target_info{type="zk",znode="/aurora/scheduler,/aurora/backup"}`] != 1 {
+		t.Errorf("no target info for the zNodes in %v", got)
+	}
+}
+
+func TestScrapeUntyped(t *testing.T) {
+	s := newTestScheduler()
+	defer s.Close()
+
+	opts := s.bypassOpts()
+	opts.Untyped = true
+	r := prometheus.NewRegistry()
+	if err := NewCollector(nil, opts).Register(r); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]dto.MetricType)
+	for _, mf := range mfs {
+		types[mf.GetName()] = mf.GetType()
+	}
+	for name, want := range map[string]dto.MetricType{
+		"aurora_jvm_uptime_secs":                         dto.MetricType_UNTYPED,
+		"aurora_scheduler_log_native_append_nanos_total": dto.MetricType_UNTYPED,
+		"aurora_up":                  dto.MetricType_GAUGE,
+		"aurora_exporter_build_info": dto.MetricType_GAUGE,
+	} {
+		if got, ok := types[name]; !ok || got != want {
+			t.Errorf("%s is of type %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeHandler serves /probe?target=<aurora-url>&znode=<paths>, scraping
+// the schedulers at target with a finder built from the current settings,
+// znode defaulting to -zk.znode. The finder of each target and znode is kept
+// for later probes, so ZooKeeper isn't reconnected to on every scrape, until
+// the finder settings change on reload. Beyond -probe.max-targets, the
+// least recently probed is closed.
+type probeHandler struct {
+	sync.Mutex
+	probes map[string]*list.Element // of lru
+	lru    *list.List               // of *probe, most recently probed first
+}
+
+type probe struct {
+	key      string
+	e        *exporter
+	h        http.Handler
+	settings *settings // the probe was last set up with
+}
+
+func newProbeHandler() *probeHandler {
+	return &probeHandler{probes: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	p, err := h.probe(target, r.URL.Query().Get("znode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.h.ServeHTTP(w, r)
+}
+
+// probe returns the probe of target and znode, creating it if there's none
+// for the current finder settings.
+func (h *probeHandler) probe(target, znode string) (*probe, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	s := currentSettings()
+	if znode == "" {
+		znode = s.znode
+	}
+
+	key := target + "\x00" + znode
+	if el, ok := h.probes[key]; ok {
+		p := el.Value.(*probe)
+		if p.settings.finderKey == s.finderKey {
+			if p.settings != s {
+				p.e.setOptions(s.collector)
+				p.settings = s
+			}
+			h.lru.MoveToFront(el)
+			return p, nil
+		}
+		h.remove(el)
+	}
+
+	f, err := s.newFinder(target, znode, "")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := s.collector
+	opts.URL, opts.Labels = target, prometheus.Labels(constLabels)
+	e := NewCollector(f, opts)
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(withLabels(e, e.labels)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	p := &probe{
+		key:      key,
+		e:        e,
+		h:        &metricsHandler{es: []*exporter{e}, h: promhttp.HandlerFor(reg, promhttp.HandlerOpts{})},
+		settings: s,
+	}
+	h.probes[key] = h.lru.PushFront(p)
+	for s.maxProbes > 0 && h.lru.Len() > s.maxProbes {
+		h.remove(h.lru.Back())
+	}
+
+	return p, nil
+}
+
+// remove closes the finder of the probe at el and forgets the probe. A
+// scrape in progress finishes with the closed finder.
+func (h *probeHandler) remove(el *list.Element) {
+	p := h.lru.Remove(el).(*probe)
+	delete(h.probes, p.key)
+	p.e.finder().Close()
+}
+
+// Close closes the finders of all probes.
+func (h *probeHandler) Close() {
+	h.Lock()
+	defer h.Unlock()
+
+	for h.lru.Len() > 0 {
+		h.remove(h.lru.Back())
+	}
+}
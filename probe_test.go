@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProbeHandlerClosesLeastRecentlyProbed(t *testing.T) {
+	config := `
+probe:
+  max_targets: "2"
+`
+	withConfigFile(t, config, func() {
+		if err := reload(nil, &clusterCollector{}, nil); err != nil {
+			t.Fatal(err)
+		}
+		h := newProbeHandler()
+		defer h.Close()
+
+		probe := func(target string) *probe {
+			p, err := h.probe(target, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}
+		a := probe("http://127.0.0.1:1/a")
+		probe("http://127.0.0.1:1/b")
+		if probe("http://127.0.0.1:1/a") != a {
+			t.Fatal("the probe of a was set up again")
+		}
+		probe("http://127.0.0.1:1/c")
+
+		if len(h.probes) != 2 || h.lru.Len() != 2 {
+			t.Fatalf("%d probes are kept, want 2", len(h.probes))
+		}
+		for _, target := range []string{"a", "c"} {
+			if _, ok := h.probes["http://127.0.0.1:1/"+target+"\x00"+currentSettings().znode]; !ok {
+				t.Errorf("the probe of %s was closed", target)
+			}
+		}
+		if probe("http://127.0.0.1:1/a") != a {
+			t.Error("the most recently probed target was closed")
+		}
+	})
+}
+
+func TestProbeFiltersMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pendingtasks":
+			w.Write([]byte("[]"))
+		default:
+			w.Write([]byte("jvm_uptime_secs 42\njvm_threads_active 7\nscheduler_lifecycle_ACTIVE 1\n"))
+		}
+	}))
+	defer srv.Close()
+
+	config := `
+metric:
+  include: aurora_jvm_.*
+  exclude: .*threads.*
+`
+	withConfigFile(t, config, func() {
+		if err := reload(nil, &clusterCollector{}, nil); err != nil {
+			t.Fatal(err)
+		}
+		h := newProbeHandler()
+		defer h.Close()
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/probe?target="+srv.URL, nil))
+		body, _ := ioutil.ReadAll(rec.Body)
+
+		if !strings.Contains(string(body), "aurora_jvm_uptime_secs") {
+			t.Errorf("the included metric is missing:\n%s", body)
+		}
+		for _, name := range []string{"aurora_jvm_threads_active", "aurora_scheduler_lifecycle"} {
+			if strings.Contains(string(body), name) {
+				t.Errorf("%s is exported despite -metric.include and -metric.exclude", name)
+			}
+		}
+	})
+}
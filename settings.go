@@ -0,0 +1,205 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// settings are the values of the flags reload may change, as they were at
+// one point. Scrapes and probes read the current settings rather than the
+// flags, which reload sets while they run.
+type settings struct {
+	// collector are the exporter settings, without URL and Labels.
+	collector     CollectorOpts
+	timeoutOffset time.Duration
+	concurrency   int
+	maxProbes     int
+
+	// finder are the finder settings, without Address, ZNode and Metrics,
+	// ZKAuth expanded.
+	finder        FinderConfig
+	znode         string // -zk.znode, not expanded
+	fallbackURL   string // -finder.fallback-url unless there are clusters
+	fallbackAfter time.Duration
+	cacheTTL      time.Duration
+	// finderKey tells whether finders built with other settings must be
+	// replaced, see finderSettings.
+	finderKey string
+
+	client *schedulerClient
+}
+
+// loadSettings takes the settings from the flags. Only main and reload may
+// call it, they are the ones setting the flags.
+func loadSettings() (*settings, error) {
+	client, err := newClientFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	zkTLS, err := newZkTLSConfig(*zkTLSCAFile, *zkTLSCertFile, *zkTLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := expandEnv(*zkAuth)
+	if err != nil {
+		return nil, err
+	}
+	include, err := compileMetricRE(*metricInclude)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compileMetricRE(*metricExclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return &settings{
+		collector: CollectorOpts{
+			Timeout:         *scrapeTimeout,
+			BreakerFailures: *breakerFailures,
+			BreakerCooldown: *breakerCooldown,
+			ServeStale:      *serveStale,
+			Include:         include,
+			Exclude:         exclude,
+			Untyped:         *compatUntyped,
+			BypassRedirect:  *bypassRedirect,
+			Retries:         *scrapeRetries,
+			VarsPath:        *varsPath,
+			NoLeaderOK:      *noLeaderOK,
+			UnknownVars:     *unknownVars,
+		},
+		timeoutOffset: *scrapeTimeoutOffset,
+		concurrency:   *scrapeConcurrency,
+		maxProbes:     *probeMaxTargets,
+		finder: FinderConfig{
+			Type:               *finderKind,
+			ZKLeaderPrefix:     *zkPrefix,
+			ZKAuth:             auth,
+			ZKReadHosts:        *zkReadHosts,
+			ZKStatuses:         *zkStatuses,
+			ZKEntityFormat:     *zkFormat,
+			ZKSessionTimeout:   *zkSessionTimeout,
+			ZKResolveInterval:  *zkResolveInterval,
+			ZKWatchInterval:    *zkWatchInterval,
+			ZKWatchMaxInterval: *zkWatchMaxInterval,
+			ZKWatchJitter:      *zkWatchJitter,
+			ZKLogEvents:        *zkLogEvents,
+			ZKTLS:              zkTLS,
+			LeaderEndpoint:     *leaderEndpoint,
+			HTTPRetries:        *httpRetries,
+			HTTPTimeout:        *httpTimeout,
+		},
+		znode:         *zkZnode,
+		fallbackURL:   fallback(),
+		fallbackAfter: *fallbackAfter,
+		cacheTTL:      *leaderCacheTTL,
+		finderKey:     finderSettings(),
+		client:        client,
+	}, nil
+}
+
+// newClientFromFlags returns the scheduler client the -http and -tls flags
+// describe.
+func newClientFromFlags() (*schedulerClient, error) {
+	c := newSchedulerClient()
+	if err := c.configureTransport(*httpMaxIdleConns, *httpIdleTimeout); err != nil {
+		return nil, err
+	}
+	if err := c.configureRateLimit(*httpRateLimit, *httpRateBurst, *httpRateFailFast); err != nil {
+		return nil, err
+	}
+	if err := c.configureTLS(*tlsCAFile, *tlsCertFile, *tlsKeyFile, *tlsInsecure); err != nil {
+		return nil, err
+	}
+	if *httpUserAgent != "" {
+		c.userAgent = *httpUserAgent
+	}
+	if err := c.configureBasicAuth(*httpUsername, *httpPassword, *httpPasswordFile); err != nil {
+		return nil, err
+	}
+	if err := c.configureBearerToken(*httpBearerFile); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+var current atomic.Value // *settings
+
+// currentSettings returns the settings set last.
+func currentSettings() *settings {
+	return current.Load().(*settings)
+}
+
+// setSettings makes s and its client the current ones.
+func setSettings(s *settings) {
+	current.Store(s)
+	setClient(s.client)
+}
+
+// newFinder returns a finder for the schedulers at url, looking for the
+// leader under znode if they are in ZooKeeper. Unless fallback is empty,
+// the schedulers at fallback are asked while those at url fail to tell the
+// leader for longer than -finder.fallback-after.
+func (s *settings) newFinder(url, znode, fallback string) (finder, error) {
+	c := s.finder
+	c.Address, c.ZNode, c.Metrics = url, znode, newFinderMetrics()
+	f, err := NewFinder(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if fallback != "" {
+		// The fallback may be of any type, -finder.type only applies to url.
+		c.Type, c.Address = "auto", fallback
+		fb, err := NewFinder(c)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f = newCompositeFinder(s.fallbackAfter, f, fb)
+	}
+
+	if s.cacheTTL > 0 {
+		f = newCachingFinder(f, s.cacheTTL)
+	}
+
+	return f, nil
+}
+
+// newFinders returns a finder for each of urls, which are replaced with
+// their expansion, see expandEnv. -zk.znode and -finder.fallback-url are
+// expanded as well. Probes don't use this, as their parameters must not be
+// expanded.
+func (s *settings) newFinders(urls []string) ([]finder, error) {
+	znode, err := expandEnv(s.znode)
+	if err != nil {
+		return nil, err
+	}
+	fb, err := expandEnv(s.fallbackURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var fs []finder
+	for i := range urls {
+		if urls[i], err = expandEnv(urls[i]); err != nil {
+			break
+		}
+
+		var f finder
+		if f, err = s.newFinder(urls[i], znode, fb); err != nil {
+			break
+		}
+		fs = append(fs, f)
+	}
+
+	if err != nil {
+		for _, f := range fs {
+			f.Close()
+		}
+		return nil, err
+	}
+
+	return fs, nil
+}
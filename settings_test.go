@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// withConfigFile runs f with -config.file set to a file holding yaml and,
+// like main, the settings taken from the flags. The flags and settings are
+// reset afterwards.
+func withConfigFile(t *testing.T, yaml string, f func()) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reset := func() {
+		if err := applyConfig(&config{}, nil); err != nil {
+			t.Fatal(err)
+		}
+		s, err := loadSettings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		setSettings(s)
+	}
+	reset()
+	defer reset()
+	flag.Set("config.file", path)
+	defer flag.Set("config.file", "")
+
+	f()
+}
+
+func TestReloadAppliesSettingsToScrapes(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen["ua "+r.UserAgent()] = true
+		seen["bypass "+r.Header.Get("Bypass-Leader-Redirect")] = true
+		seen["path "+r.URL.Path] = true
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/pendingtasks":
+			w.Write([]byte("[]"))
+		default:
+			w.Write([]byte("jvm_uptime_secs 42\nsome_unknown_var 1\n"))
+		}
+	}))
+	defer srv.Close()
+
+	config := `
+bypass_leader_redirect: "true"
+unknown_vars: "true"
+scrape:
+  path: /vars.txt
+http:
+  user_agent: reloaded
+`
+	withConfigFile(t, config, func() {
+		opts := currentSettings().collector
+		opts.URL = srv.URL
+		e := NewCollector(&httpFinder{url: srv.URL, timeout: opts.Timeout, metrics: newFinderMetrics()}, opts)
+		c := &clusterCollector{collectors: []prometheus.Collector{e}}
+
+		// Scrapes keep running while the settings are swapped underneath.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 5; i++ {
+				collect(t, c)
+			}
+		}()
+		for i := 0; i < 5; i++ {
+			if err := reload([]*exporter{e}, c, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		<-done
+
+		got := collect(t, c)
+		if got["aurora_some_unknown_var"] != 1 {
+			t.Errorf("unknown vars aren't exported after the reload: %v", got)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, want := range []string{"ua reloaded", "bypass true", "path /vars.txt"} {
+			if !seen[want] {
+				t.Errorf("no request with %s after the reload, saw %v", want, seen)
+			}
+		}
+	})
+}
+
+func TestReloadKeepsSettingsOnError(t *testing.T) {
+	withConfigFile(t, "metric:\n  include: \"(\"\n", func() {
+		before := currentSettings()
+		if err := reload(nil, &clusterCollector{}, nil); err == nil {
+			t.Fatal("a bad metric.include was accepted")
+		}
+		if currentSettings() != before {
+			t.Error("the settings changed despite the error")
+		}
+	})
+}
+
+func TestReloadAppliesConcurrency(t *testing.T) {
+	withConfigFile(t, "scrape:\n  concurrency: \"2\"\n", func() {
+		c := &clusterCollector{}
+		if err := reload(nil, c, nil); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&c.concurrency); n != 2 {
+			t.Errorf("concurrency is %d after the reload, want 2", n)
+		}
+	})
+}
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// newDesc returns the descriptor of a var's metric. Registering fails for
+// descriptors without help, so those get the one of unknown vars.
 func newDesc(subsys, name, descr string) *prometheus.Desc {
 	fqn := prometheus.BuildFQName(namespace, subsys, name)
+	if descr == "" {
+		descr = "Aurora scheduler var " + strings.TrimPrefix(fqn, namespace+"_") + "."
+	}
 	return prometheus.NewDesc(fqn, descr, nil, nil)
 }
 
@@ -486,13 +499,142 @@ var gauges = map[string]*prometheus.Desc{
 	),
 }
 
+// decodeVars decodes the stats in resp, as JSON if it is served as
+// application/json, as /vars text if served as any other type and, without a
+// Content-Type, as JSON if the path ends in .json. Both yield the same vars.
+func decodeVars(resp *http.Response) (vars map[string]interface{}, malformed int, err error) {
+	isJSON := strings.HasSuffix(resp.Request.URL.Path, ".json")
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		isJSON = err == nil && mt == "application/json"
+	}
+
+	if !isJSON {
+		return decodeVarsText(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&vars)
+
+	return vars, 0, err
+}
+
+// decodeVarsText reads the "name value" lines /vars serves. Lines whose
+// value isn't a number are kept as strings, like in /vars.json, and
+// skipped by the metrics. Non-empty lines without a value are skipped and
+// counted as malformed.
+func decodeVarsText(r io.Reader) (vars map[string]interface{}, malformed int, err error) {
+	vars = make(map[string]interface{})
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			malformed++
+			continue
+		}
+
+		if v, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err == nil {
+			vars[parts[0]] = v
+		} else {
+			vars[parts[0]] = parts[1]
+		}
+	}
+
+	return vars, malformed, s.Err()
+}
+
+// percentileRE matches the percentile suffixes Aurora stats carry.
+var percentileRE = regexp.MustCompile("^(.+)_p(50|90|99|999|9999)$")
+
+// quantiles are the quantiles of the percentile suffixes.
+var quantiles = map[string]string{
+	"50":   "0.5",
+	"90":   "0.9",
+	"99":   "0.99",
+	"999":  "0.999",
+	"9999": "0.9999",
+}
+
+// percentileVars exports those of names that share a base name and have a
+// percentile suffix, like op_ms_p50 and op_ms_p99, as one aurora_op_ms metric
+// with a quantile label. It returns the metric names it used and the names
+// it didn't consume.
+func percentileVars(ch chan<- prometheus.Metric, vars map[string]interface{}, names []string) (metrics map[string]bool, rest []string) {
+	metrics = make(map[string]bool)
+
+	sort.Strings(names)
+	descs := make(map[string]*prometheus.Desc)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		match := percentileRE.FindStringSubmatch(name)
+		if match == nil {
+			rest = append(rest, name)
+			continue
+		}
+
+		base := metricName(match[1])
+		q := quantiles[match[2]]
+		if seen[base+" "+q] {
+			continue
+		}
+		seen[base+" "+q] = true
+
+		desc, ok := descs[base]
+		if !ok {
+			desc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", base),
+				"Percentiles of Aurora scheduler var "+match[1]+".", []string{"quantile"}, nil)
+			descs[base] = desc
+			metrics[base] = true
+		}
+
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, vars[name].(float64), q)
+	}
+
+	return metrics, rest
+}
+
+// Metrics derived from several vars or pending tasks rather than one var.
+var (
+	jobsDesc = newDesc(
+		"", "jobs",
+		"Number of jobs with tasks in the task store.",
+	)
+	jobsPendingDesc = newDesc(
+		"jobs", "pending",
+		"Number of jobs with pending tasks.",
+	)
+)
+
+// tasksRE matches the task vars of all jobs, tasks_<state> or
+// tasks.<state>, and those per job, tasks_<state>_<role>/<env>/<job>. States
+// are upper case, like RUNNING or SANDBOX_CREATED. Role, env and job are
+// empty for all jobs.
+var tasksRE = regexp.MustCompile("^tasks[_.](?P<state>[A-Z]+(?:_[A-Z]+)*)(?:_(?P<role>[^/]*)/(?P<env>[^/]*)/(?P<job>.*))?$")
+
+// countJobs returns the number of distinct jobs the per-job task vars name.
+func countJobs(vars map[string]interface{}) int {
+	jobs := make(map[string]bool)
+	for name := range vars {
+		if match := tasksRE.FindStringSubmatch(name); len(match) == 5 && match[4] != "" {
+			jobs[match[2]+"/"+match[3]+"/"+match[4]] = true
+		}
+	}
+
+	return len(jobs)
+}
+
 type parser struct {
 	match  int
 	metric prometheus.Collector
 	regex  *regexp.Regexp
 }
 
-func (p *parser) parse(name string, value float64, ch chan<- prometheus.Metric) {
+func (p *parser) parse(name string, value float64, ch chan<- prometheus.Metric) bool {
 	match := p.regex.FindStringSubmatch(name)
 	if len(match) == p.match {
 		var metric prometheus.Metric
@@ -508,158 +650,315 @@ func (p *parser) parse(name string, value float64, ch chan<- prometheus.Metric)
 
 		if metric != nil {
 			ch <- metric
+			return true
 		}
 	}
+
+	return false
 }
 
-var prefixParser = map[string]*parser{
-	"tasks_": &parser{
-		match: 5,
-		metric: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Namespace: namespace,
-				Name:      "tasks",
-				Help:      "Task state per job.",
-			},
-			[]string{"state", "role", "env", "job"},
-		),
-		regex: regexp.MustCompile("tasks_(?P<state>.*)_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)"),
-	},
-	"tasks_lost_rack_": &parser{
-		match: 2,
-		metric: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Namespace: namespace,
-				Name:      "tasks_lost_rack",
-				Help:      "Task lost per rack total.",
-			},
-			[]string{"rack"},
-		),
-		regex: regexp.MustCompile("tasks_lost_rack_(?P<rack>.*)"),
-	},
-	"task_store_": &parser{
-		match: 2,
-		metric: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "task_store",
-				Help:      "Task store state.",
-			},
-			[]string{"state"},
-		),
-		regex: regexp.MustCompile("task_store_(?P<state>[A-Z]+)"),
-	},
-	"update_transition_": &parser{
-		match: 2,
-		metric: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Namespace: namespace,
-				Name:      "update_transition",
-				Help:      "Update transition.",
-			},
-			[]string{"state"},
-		),
-		regex: regexp.MustCompile("update_transition_(?P<state>.*)"),
-	},
-	"scheduler_lifecycle_": &parser{
-		match: 2,
-		metric: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "scheduler_lifecycle",
-				Help:      "Scheduler lifecycle.",
-			},
-			[]string{"state"},
-		),
-		regex: regexp.MustCompile("scheduler_lifecycle_(?P<state>[A-Z]+)"),
-	},
+// parsers are the parsers of the vars with labels in their name, by the
+// prefix or suffix they apply to. Their vectors keep the values last set,
+// so every exporter has its own, see newParsers.
+type parsers struct {
+	prefix map[string]*parser
+	suffix map[string]*parser
 }
 
-var suffixParser = map[string]*parser{
-	"_mtta_ms": &parser{
-		match: 4,
-		metric: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "sla_mtta_ms",
-				Help:      "Median time to assigned.",
-			},
-			[]string{"role", "env", "job"},
-		),
-		regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_mtta_ms$"),
-	},
-	"_mttr_ms": &parser{
-		match: 4,
-		metric: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "sla_mttr_ms",
-				Help:      "Median time to running.",
-			},
-			[]string{"role", "env", "job"},
-		),
-		regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_mttr_ms$"),
-	},
-	"_mtta_ms_nonprod": &parser{
-		match: 4,
-		metric: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "sla_mtta_ms_nonprod",
-				Help:      "Median time to assigned nonprod.",
-			},
-			[]string{"role", "env", "job"},
-		),
-		regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_mtta_ms_nonprod$"),
-	},
-	"_mttr_ms_nonprod": &parser{
-		match: 4,
-		metric: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "sla_mttr_ms_nonprod",
-				Help:      "Median time to running nonprod.",
-			},
-			[]string{"role", "env", "job"},
-		),
-		regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_mttr_ms_nonprod$"),
-	},
-	"_platform_uptime_percent": &parser{
-		match: 4,
-		metric: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "sla_platform_uptime_percent",
-				Help:      "Aggregate platform uptime.",
-			},
-			[]string{"role", "env", "job"},
-		),
-		regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_platform_uptime_percent$"),
-	},
-	"_platform_uptime_percent_nonprod": &parser{
-		match: 4,
-		metric: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "sla_platform_uptime_percent_nonprod",
-				Help:      "Aggregate platform uptime nonprod.",
-			},
-			[]string{"role", "env", "job"},
-		),
-		regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_platform_uptime_percent_nonprod$"),
-	},
+func newParsers() parsers {
+	return parsers{prefix: newPrefixParsers(), suffix: newSuffixParsers()}
+}
+
+func newPrefixParsers() map[string]*parser {
+	return map[string]*parser{
+		"tasks": &parser{
+			match: 5,
+			metric: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "tasks",
+					Help:      "Task state per job, of all jobs without role, env and job.",
+				},
+				[]string{"state", "role", "env", "job"},
+			),
+			regex: tasksRE,
+		},
+		"tasks_lost_rack_": &parser{
+			match: 2,
+			metric: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "tasks_lost_rack",
+					Help:      "Task lost per rack total.",
+				},
+				[]string{"rack"},
+			),
+			regex: regexp.MustCompile("tasks_lost_rack_(?P<rack>.*)"),
+		},
+		"task_store_": &parser{
+			match: 2,
+			metric: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "task_store",
+					Help:      "Task store state.",
+				},
+				[]string{"state"},
+			),
+			regex: regexp.MustCompile("task_store_(?P<state>[A-Z]+)"),
+		},
+		"update_transition_": &parser{
+			match: 2,
+			metric: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "update_transition",
+					Help:      "Update transition.",
+				},
+				[]string{"state"},
+			),
+			regex: regexp.MustCompile("update_transition_(?P<state>.*)"),
+		},
+		"scheduler_lifecycle_": &parser{
+			match: 2,
+			metric: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "scheduler_lifecycle",
+					Help:      "Scheduler lifecycle.",
+				},
+				[]string{"state"},
+			),
+			regex: regexp.MustCompile("scheduler_lifecycle_(?P<state>[A-Z]+)"),
+		},
+	}
+}
+
+func newSuffixParsers() map[string]*parser {
+	return map[string]*parser{
+		"_mtta_ms": &parser{
+			match: 4,
+			metric: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "sla_mtta_ms",
+					Help:      "Median time to assigned.",
+				},
+				[]string{"role", "env", "job"},
+			),
+			regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_mtta_ms$"),
+		},
+		"_mttr_ms": &parser{
+			match: 4,
+			metric: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "sla_mttr_ms",
+					Help:      "Median time to running.",
+				},
+				[]string{"role", "env", "job"},
+			),
+			regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_mttr_ms$"),
+		},
+		"_mtta_ms_nonprod": &parser{
+			match: 4,
+			metric: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "sla_mtta_ms_nonprod",
+					Help:      "Median time to assigned nonprod.",
+				},
+				[]string{"role", "env", "job"},
+			),
+			regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_mtta_ms_nonprod$"),
+		},
+		"_mttr_ms_nonprod": &parser{
+			match: 4,
+			metric: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "sla_mttr_ms_nonprod",
+					Help:      "Median time to running nonprod.",
+				},
+				[]string{"role", "env", "job"},
+			),
+			regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_mttr_ms_nonprod$"),
+		},
+		"_platform_uptime_percent": &parser{
+			match: 4,
+			metric: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "sla_platform_uptime_percent",
+					Help:      "Aggregate platform uptime.",
+				},
+				[]string{"role", "env", "job"},
+			),
+			regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_platform_uptime_percent$"),
+		},
+		"_platform_uptime_percent_nonprod": &parser{
+			match: 4,
+			metric: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "sla_platform_uptime_percent_nonprod",
+					Help:      "Aggregate platform uptime nonprod.",
+				},
+				[]string{"role", "env", "job"},
+			),
+			regex: regexp.MustCompile("sla_(?P<role>.*)/(?P<env>.*)/(?P<job>.*)_platform_uptime_percent_nonprod$"),
+		},
+	}
 }
 
-func labelVars(ch chan<- prometheus.Metric, name string, value float64) {
-	for prefix, parser := range prefixParser {
+// labelVars exports name through the prefix and suffix parsers matching it
+// and reports whether any did.
+func (p parsers) labelVars(ch chan<- prometheus.Metric, name string, value float64) bool {
+	var matched bool
+	for prefix, parser := range p.prefix {
 		if strings.HasPrefix(name, prefix) {
-			parser.parse(name, value, ch)
+			matched = parser.parse(name, value, ch) || matched
 		}
 	}
 
-	for suffix, parser := range suffixParser {
+	for suffix, parser := range p.suffix {
 		if strings.HasSuffix(name, suffix) {
-			parser.parse(name, value, ch)
+			matched = parser.parse(name, value, ch) || matched
 		}
 	}
+
+	return matched
+}
+
+// varTypes classifies vars without a known metric by their name suffix, the
+// first match wins. Rates are checked before counters, since Aurora derives
+// them from counters, e.g. http_200_responses_events_per_sec.
+var varTypes = []struct {
+	suffix    string
+	valueType prometheus.ValueType
+}{
+	{"_per_sec", prometheus.GaugeValue},
+	{"_per_event", prometheus.GaugeValue},
+	{"_total", prometheus.CounterValue},
+	{"_events", prometheus.CounterValue},
+	{"_count", prometheus.CounterValue},
+	{"_ms", prometheus.GaugeValue},
+	{"_bytes", prometheus.GaugeValue},
+	{"_ratio", prometheus.GaugeValue},
+	{"_percent", prometheus.GaugeValue},
+	{"_size", prometheus.GaugeValue},
+}
+
+// classifyVar returns the metric type of the var name, untyped if unknown.
+func classifyVar(name string) prometheus.ValueType {
+	for _, t := range varTypes {
+		if strings.HasSuffix(name, t.suffix) {
+			return t.valueType
+		}
+	}
+
+	return prometheus.UntypedValue
+}
+
+var invalidMetricChars = regexp.MustCompile("[^a-z0-9_:]+")
+
+// metricName maps a var name to a valid metric name the way the known
+// metrics are named: lowercased, with dots, slashes, dashes and other
+// invalid characters replaced by a single underscore.
+func metricName(name string) string {
+	return strings.Trim(invalidMetricChars.ReplaceAllString(strings.ToLower(name), "_"), "_")
+}
+
+var fqNameRE = regexp.MustCompile(`^Desc{fqName: "([^"]*)"`)
+
+// metricFQName returns the metric name of d, which Desc has no accessor for
+// but leads its String with.
+func metricFQName(d *prometheus.Desc) string {
+	if m := fqNameRE.FindStringSubmatch(d.String()); m != nil {
+		return m[1]
+	}
+
+	return ""
+}
+
+// compileMetricRE compiles the -metric.include or -metric.exclude regexp,
+// anchored at both ends. It returns nil for an empty one.
+func compileMetricRE(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// untypedMetric is a counter or gauge written as untyped, see
+// -compat.untyped.
+type untypedMetric struct {
+	prometheus.Metric
+}
+
+func (m untypedMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+
+	switch {
+	case out.Counter != nil:
+		out.Untyped, out.Counter = &dto.Untyped{Value: out.Counter.Value}, nil
+	case out.Gauge != nil:
+		out.Untyped, out.Gauge = &dto.Untyped{Value: out.Gauge.Value}, nil
+	}
+
+	return nil
+}
+
+// frozenMetric is what a metric wrote when frozen, unaffected by later
+// changes of a mutable metric such as the children of a GaugeVec.
+type frozenMetric struct {
+	desc *prometheus.Desc
+	dto.Metric
+}
+
+// freeze copies m as it is now, metrics kept past their scrape are frozen.
+func freeze(m prometheus.Metric) (prometheus.Metric, error) {
+	f := &frozenMetric{desc: m.Desc()}
+	if err := m.Write(&f.Metric); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (m *frozenMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m *frozenMetric) Write(out *dto.Metric) error {
+	*out = m.Metric
+	return nil
+}
+
+// describeVars sends the descriptors of the metrics made from known vars.
+// Those of percentiles and unknown vars are only known once scraped, they
+// are left out and collected unchecked.
+func (p parsers) describeVars(ch chan<- *prometheus.Desc) {
+	ch <- jobsDesc
+	ch <- jobsPendingDesc
+	for _, desc := range counters {
+		ch <- desc
+	}
+	for _, desc := range gauges {
+		ch <- desc
+	}
+	for _, parser := range p.prefix {
+		parser.metric.Describe(ch)
+	}
+	for _, parser := range p.suffix {
+		parser.metric.Describe(ch)
+	}
+}
+
+// unknownVarDesc builds the description of a var without a known metric.
+func unknownVarDesc(name string) *prometheus.Desc {
+	return newDesc("", metricName(name), "Aurora scheduler var "+name+".")
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// scrapeVars serves body as the stats of a scheduler and returns the metrics
+// e.parseVars makes of them.
+func scrapeVars(t *testing.T, e *exporter, contentType, body string) map[string]float64 {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	return collectFunc(t, func(ch chan<- prometheus.Metric) {
+		if err := e.parseVars(ctx, srv.URL, false, ch); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestPercentileVarsGrouped(t *testing.T) {
+	got := scrapeVars(t, NewCollector(nil, CollectorOpts{UnknownVars: true}), "application/json",
+		`{"op_ms_p50": 1, "op_ms_p90": 2, "op_ms_p99": 3, "op_ms_p999": 4, "op_ms_p9999": 5}`)
+
+	want := map[string]float64{
+		`aurora_op_ms{quantile="0.5"}`:    1,
+		`aurora_op_ms{quantile="0.9"}`:    2,
+		`aurora_op_ms{quantile="0.99"}`:   3,
+		`aurora_op_ms{quantile="0.999"}`:  4,
+		`aurora_op_ms{quantile="0.9999"}`: 5,
+	}
+	for series, v := range want {
+		if got[series] != v {
+			t.Errorf("%s = %v, want %v", series, got[series], v)
+		}
+	}
+}
+
+func TestPercentileVarsLeaveOtherSuffixes(t *testing.T) {
+	got := scrapeVars(t, NewCollector(nil, CollectorOpts{UnknownVars: true}), "application/json",
+		`{"tasks_RUNNING_www/prod/web_p2": 3, "op_ms_p100": 7, "op_ms_p5": 8}`)
+
+	// A job named web_p2 keeps its per-job metric.
+	if v := got[`aurora_tasks{env="prod",job="web_p2",role="www",state="RUNNING"}`]; v != 3 {
+		t.Errorf("tasks of job web_p2 = %v, want 3, got %v", v, got)
+	}
+	// Suffixes Aurora doesn't export aren't percentiles.
+	if v := got["aurora_op_ms_p100"]; v != 7 {
+		t.Errorf("aurora_op_ms_p100 = %v, want 7, got %v", v, got)
+	}
+	if v := got["aurora_op_ms_p5"]; v != 8 {
+		t.Errorf("aurora_op_ms_p5 = %v, want 8, got %v", v, got)
+	}
+	for series := range got {
+		if series == `aurora_op_ms{quantile="0.1"}` || series == `aurora_op_ms{quantile="0.05"}` {
+			t.Errorf("unexpected percentile %s", series)
+		}
+	}
+}
+
+func TestPercentileVarsNeedUnknownVars(t *testing.T) {
+	got := scrapeVars(t, NewCollector(nil, CollectorOpts{}), "application/json", `{"op_ms_p50": 1}`)
+	if _, ok := got[`aurora_op_ms{quantile="0.5"}`]; ok {
+		t.Errorf("percentile exported without -exporter.unknown-vars: %v", got)
+	}
+}
+
+func TestUnknownVarCollisionsCounted(t *testing.T) {
+	e := NewCollector(nil, CollectorOpts{UnknownVars: true})
+	body := `{"foo.bar_count": 1, "foo/bar_count": 2, "foo-bar.count": 3}`
+
+	for i := 1; i <= 2; i++ {
+		got := scrapeVars(t, e, "application/json", body)
+		if v := got["aurora_foo_bar_count"]; v != 3 {
+			t.Errorf("aurora_foo_bar_count = %v, want the value of foo-bar.count, first in sort order", v)
+		}
+		if v := collect(t, e.droppedVars)["aurora_scrape_dropped_vars_total"]; v != float64(2*i) {
+			t.Errorf("after scrape %d, %v vars were counted as dropped, want %d", i, v, 2*i)
+		}
+	}
+}
+
+func TestDecodeVarsTextAndJSON(t *testing.T) {
+	tests := []struct {
+		path, contentType, body string
+	}{
+		{"/vars", "text/plain", "jvm_uptime_secs 42\nsystem_load_avg 1.5\nscheduler_lifecycle_ACTIVE 1\nbuild_git_tag v1 2\n"},
+		{"/vars", "", "jvm_uptime_secs 42\nsystem_load_avg 1.5\nscheduler_lifecycle_ACTIVE 1\nbuild_git_tag v1 2\n"},
+		{"/vars.json", "application/json; charset=utf-8",
+			`{"jvm_uptime_secs": 42, "system_load_avg": 1.5, "scheduler_lifecycle_ACTIVE": 1, "build_git_tag": "v1 2"}`},
+		{"/vars.json", "", `{"jvm_uptime_secs": 42, "system_load_avg": 1.5, "scheduler_lifecycle_ACTIVE": 1, "build_git_tag": "v1 2"}`},
+	}
+
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header()["Content-Type"] = []string{test.contentType}
+			w.Write([]byte(test.body))
+		}))
+		resp, err := http.Get(srv.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vars, malformed, err := decodeVars(resp)
+		resp.Body.Close()
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s as %q: %s", test.path, test.contentType, err)
+			continue
+		}
+
+		if malformed != 0 || vars["jvm_uptime_secs"] != 42.0 || vars["system_load_avg"] != 1.5 ||
+			vars["scheduler_lifecycle_ACTIVE"] != 1.0 || vars["build_git_tag"] != "v1 2" {
+			t.Errorf("%s as %q: got %v, %d malformed", test.path, test.contentType, vars, malformed)
+		}
+	}
+}
+
+func TestDecodeVarsTextCountsMalformedLines(t *testing.T) {
+	_, malformed, err := decodeVarsText(strings.NewReader("jvm_uptime_secs 42\nlonely\n\n  \nsystem_load_avg 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if malformed != 1 {
+		t.Errorf("%d malformed lines, want 1", malformed)
+	}
+}
+
+func TestParseVarsUsesScrapePath(t *testing.T) {
+	for _, path := range []string{"/vars", "/vars.json"} {
+		var asked string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			asked = r.URL.Path
+			if r.URL.Path == "/vars.json" {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"jvm_uptime_secs": 42}`))
+				return
+			}
+			w.Write([]byte("jvm_uptime_secs 42\n"))
+		}))
+
+		func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			got := collectFunc(t, func(ch chan<- prometheus.Metric) {
+				if err := NewCollector(nil, CollectorOpts{VarsPath: path}).parseVars(ctx, srv.URL, false, ch); err != nil {
+					t.Error(err)
+				}
+			})
+			if got["aurora_jvm_uptime_secs"] != 42 {
+				t.Errorf("path %s: got %v", path, got)
+			}
+		}()
+		srv.Close()
+
+		if asked != path {
+			t.Errorf("scraped %s, want %s", asked, path)
+		}
+	}
+}
+
+func TestLabelVarsPerExporter(t *testing.T) {
+	a, b := NewCollector(nil, CollectorOpts{}), NewCollector(nil, CollectorOpts{})
+	scrapeVars(t, a, "application/json", `{"tasks_RUNNING_www/prod/hello": 1, "sla_www/prod/hello_mtta_ms": 10}`)
+	scrapeVars(t, b, "application/json", `{"tasks_RUNNING_www/prod/hello": 2}`)
+
+	series := `aurora_tasks{env="prod",job="hello",role="www",state="RUNNING"}`
+	if got := collect(t, a.parsers.prefix["tasks"].metric)[series]; got != 1 {
+		t.Errorf("%s of the first exporter = %v after scraping the second, want 1", series, got)
+	}
+	if got := collect(t, b.parsers.suffix["_mtta_ms"].metric); len(got) != 0 {
+		t.Errorf("the second exporter has the first one's SLA metrics: %v", got)
+	}
+}
+
+func TestTaskVarsFixture(t *testing.T) {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "vars.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := scrapeVars(t, NewCollector(nil, CollectorOpts{}), "text/plain", string(body))
+
+	for series, want := range map[string]float64{
+		// All jobs, with either separator.
+		`aurora_tasks{env="",job="",role="",state="FAILED"}`:          12,
+		`aurora_tasks{env="",job="",role="",state="KILLED"}`:          19,
+		`aurora_tasks{env="",job="",role="",state="LOST"}`:            4,
+		`aurora_tasks{env="",job="",role="",state="RUNNING"}`:         41,
+		`aurora_tasks{env="",job="",role="",state="SANDBOX_CREATED"}`: 2,
+		// Per job.
+		`aurora_tasks{env="prod",job="hello",role="www-data",state="FAILED"}`:          7,
+		`aurora_tasks{env="prod",job="world",role="www-data",state="FAILED"}`:          5,
+		`aurora_tasks{env="prod",job="hello",role="www-data",state="RUNNING"}`:         40,
+		`aurora_tasks{env="prod",job="hello",role="www-data",state="SANDBOX_CREATED"}`: 2,
+		`aurora_tasks_lost_rack{rack="r12"}`:                                           4,
+		`aurora_task_store{state="RUNNING"}`:                                           41,
+		"aurora_jobs":                                                                  2,
+	} {
+		if v, ok := got[series]; !ok || v != want {
+			t.Errorf("%s = %v, want %v", series, v, want)
+		}
+	}
+
+	var tasks int
+	for series := range got {
+		if strings.HasPrefix(series, "aurora_tasks{") {
+			tasks++
+		}
+	}
+	if tasks != 10 {
+		t.Errorf("got %d task series, want 10: %v", tasks, got)
+	}
+}
+
+func TestClassifyVar(t *testing.T) {
+	for name, want := range map[string]prometheus.ValueType{
+		"scheduler_log_native_append_total":  prometheus.CounterValue,
+		"framework_registered_events":        prometheus.CounterValue,
+		"offer_accept_races_count":           prometheus.CounterValue,
+		"http_200_responses_events_per_sec":  prometheus.GaugeValue,
+		"http_200_responses_nanos_per_event": prometheus.GaugeValue,
+		"scheduler_resource_offers_ms":       prometheus.GaugeValue,
+		"jvm_memory_heap_mb_used_bytes":      prometheus.GaugeValue,
+		"preemptor_slot_hit_ratio":           prometheus.GaugeValue,
+		"quota_used_percent":                 prometheus.GaugeValue,
+		"task_queue_size":                    prometheus.GaugeValue,
+		"system_load_avg":                    prometheus.UntypedValue,
+		"total_requests":                     prometheus.UntypedValue,
+		"timeout_events_ms_x":                prometheus.UntypedValue,
+	} {
+		if got := classifyVar(name); got != want {
+			t.Errorf("classifyVar(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestUnknownVarTypes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("sample_total 1\nsample_events_per_sec 2\nsample_ms 3\nsample_load 4\n"))
+	}))
+	defer srv.Close()
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		defer close(ch)
+		if err := NewCollector(nil, CollectorOpts{UnknownVars: true}).parseVars(context.Background(), srv.URL, false, ch); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	types := make(map[string]string)
+	for m := range ch {
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case out.Counter != nil:
+			types[metricFQName(m.Desc())] = "counter"
+		case out.Gauge != nil:
+			types[metricFQName(m.Desc())] = "gauge"
+		case out.Untyped != nil:
+			types[metricFQName(m.Desc())] = "untyped"
+		}
+	}
+	for name, want := range map[string]string{
+		"aurora_sample_total":          "counter",
+		"aurora_sample_events_per_sec": "gauge",
+		"aurora_sample_ms":             "gauge",
+		"aurora_sample_load":           "untyped",
+	} {
+		if types[name] != want {
+			t.Errorf("%s is a %q, want a %s", name, types[name], want)
+		}
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	for name, want := range map[string]string{
+		"jvm_uptime_secs":                 "jvm_uptime_secs",
+		"tasks.FAILED":                    "tasks_failed",
+		"sla/job/uptime":                  "sla_job_uptime",
+		"http-client.requests":            "http_client_requests",
+		"jvm_gc_PS_MarkSweep_collections": "jvm_gc_ps_marksweep_collections",
+		"a..b//c":                         "a_b_c",
+		"/leading.and.trailing/":          "leading_and_trailing",
+		"ratio:rate":                      "ratio:rate",
+		"space and%percent":               "space_and_percent",
+	} {
+		if got := metricName(name); got != want {
+			t.Errorf("metricName(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	// Distinct vars may map to the same name, see
+	// TestUnknownVarCollisionsCounted.
+	if metricName("tasks.FAILED") != metricName("tasks_failed") {
+		t.Error("tasks.FAILED and tasks_failed map to different names")
+	}
+}
+
+func TestTaskVarLabels(t *testing.T) {
+	for name, want := range map[string][]string{
+		"tasks_FAILED":                     {"FAILED", "", "", ""},
+		"tasks.RUNNING":                    {"RUNNING", "", "", ""},
+		"tasks_SANDBOX_CREATED":            {"SANDBOX_CREATED", "", "", ""},
+		"tasks_FAILED_www/prod/hello":      {"FAILED", "www", "prod", "hello"},
+		"tasks_LOST_www_data/prod/hello":   {"LOST", "www_data", "prod", "hello"},
+		"tasks_SANDBOX_CREATED_www/dev/hi": {"SANDBOX_CREATED", "www", "dev", "hi"},
+		"tasks_lost_rack_r1":               nil,
+		"tasks_failed":                     nil,
+		"async_tasks_FAILED":               nil,
+	} {
+		match := tasksRE.FindStringSubmatch(name)
+		var got []string
+		if match != nil {
+			got = match[1:]
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") || (got == nil) != (want == nil) {
+			t.Errorf("%s got state, role, env and job %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseVarsGzip(t *testing.T) {
+	body := "jvm_uptime_secs 42\ntasks_RUNNING_www/prod/hello 3\n"
+	for _, compress := range []bool{true, false} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				t.Errorf("the scrape didn't accept gzip, got Accept-Encoding %q", r.Header.Get("Accept-Encoding"))
+			}
+			if !compress {
+				w.Write([]byte(body))
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(body))
+			gz.Close()
+		}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		got := collectFunc(t, func(ch chan<- prometheus.Metric) {
+			if err := NewCollector(nil, CollectorOpts{}).parseVars(ctx, srv.URL, false, ch); err != nil {
+				t.Error(err)
+			}
+		})
+		cancel()
+		srv.Close()
+
+		if got["aurora_jvm_uptime_secs"] != 42 || got[`aurora_tasks{env="prod",job="hello",role="www",state="RUNNING"}`] != 3 {
+			t.Errorf("compressed %t, got %v", compress, got)
+		}
+	}
+}
+
+func TestPercentileVarsCountedAsSamples(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pendingtasks":
+			w.Write([]byte("[]"))
+		case "/vars":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"op_ms_p50": 1, "op_ms_p90": 2, "op_ms_p99": 3, "op_ms_p999": 4, "op_ms_p9999": 5}`))
+		}
+	}))
+	defer srv.Close()
+
+	e := NewCollector(nil, CollectorOpts{URL: srv.URL, BypassRedirect: true, Timeout: time.Second, UnknownVars: true})
+	got := collect(t, e)
+
+	// The five quantiles of the summary, and the number of jobs with and
+	// without pending tasks.
+	if v := got["aurora_exporter_last_scrape_samples"]; v != 7 {
+		t.Errorf("aurora_exporter_last_scrape_samples = %v, want 7", v)
+	}
+	if v := got[`aurora_op_ms{quantile="0.99"}`]; v != 3 {
+		t.Errorf("the 0.99 quantile is %v, want 3", v)
+	}
+}
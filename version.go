@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Set at build time via -ldflags "-X main.version=... -X main.revision=...".
+var (
+	version  = "unknown"
+	revision = "unknown"
+	branch   = "unknown"
+)
+
+var buildInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_build_info",
+		Help:      "Version, revision, branch and Go version the exporter was built with, always 1",
+	},
+	[]string{"version", "revision", "branch", "goversion"},
+)
+
+func init() {
+	buildInfo.WithLabelValues(version, revision, branch, runtime.Version()).Set(1)
+}
+
+// versionInfo is what -version prints.
+func versionInfo() string {
+	return fmt.Sprintf("aurora_exporter, version %s (branch: %s, revision: %s)\n  go version: %s",
+		version, branch, revision, runtime.Version())
+}
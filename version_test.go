@@ -0,0 +1,28 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	got := collect(t, buildInfo)
+	series := `aurora_exporter_build_info{branch="` + branch + `",goversion="` + runtime.Version() +
+		`",revision="` + revision + `",version="` + version + `"}`
+	if got[series] != 1 {
+		t.Errorf("no %s in %v", series, got)
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	defer func(v, r, b string) { version, revision, branch = v, r, b }(version, revision, branch)
+	version, revision, branch = "1.2.3", "abc123", "master"
+
+	got := versionInfo()
+	for _, want := range []string{"version 1.2.3", "branch: master", "revision: abc123", runtime.Version()} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q lacks %q", got, want)
+		}
+	}
+}